@@ -0,0 +1,353 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cwood/dotgraph/redact"
+	"github.com/stretchr/testify/mock"
+)
+
+// Interaction is a recorded command or PATH lookup and its result
+type Interaction struct {
+	// LookPath is set for PATH lookups, which only record Path and Error
+	LookPath string `json:"lookpath,omitempty"`
+	Path     string `json:"path,omitempty"`
+
+	Name  string   `json:"name,omitempty"`
+	Args  []string `json:"args,omitempty"`
+	Dir   string   `json:"dir,omitempty"`
+	Env   []string `json:"env,omitempty"`
+	Stdin string   `json:"stdin,omitempty"`
+	Sudo  bool     `json:"sudo,omitempty"`
+
+	Success  bool          `json:"success,omitempty"`
+	Stdout   string        `json:"stdout,omitempty"`
+	Stderr   string        `json:"stderr,omitempty"`
+	ExitCode int           `json:"exit_code"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// matches reports whether the interaction was recorded for cmd
+func (i Interaction) matches(cmd Cmd, stdin string) bool {
+	return i.LookPath == "" &&
+		i.Name == cmd.Name &&
+		slices.Equal(i.Args, cmd.Args) &&
+		i.Dir == cmd.Dir &&
+		slices.Equal(i.Env, cmd.Env) &&
+		i.Stdin == stdin &&
+		i.Sudo == cmd.Sudo
+}
+
+// describe returns the command line of the interaction for error messages
+func (i Interaction) describe() string {
+	if i.LookPath != "" {
+		return "LookPath(" + i.LookPath + ")"
+	}
+	return Cmd{Name: i.Name, Args: i.Args, Env: i.Env, Sudo: i.Sudo}.String()
+}
+
+// Cassette is a list of recorded interactions, stored as JSON
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// LoadCassette reads a cassette written by RecordingExecutor
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("cassette %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// Save writes the cassette to path
+func (c *Cassette) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// RecordingExecutor runs commands through another executor, usually a
+// RealExecutor, and records every command and PATH lookup so the run can be
+// replayed with ReplayExecutor. Call Save or Close to write the cassette.
+//
+// Secrets are masked in the recorded args, env, stdin, output and errors,
+// so cassettes can be checked in. The command that runs is not changed.
+type RecordingExecutor struct {
+	// Executor runs the commands
+	Executor CommandExecutor
+
+	// Path is where Save writes the cassette
+	Path string
+
+	// Redactor masks secrets in the cassette. If nil, redact.Default is
+	// used.
+	Redactor *redact.Redactor
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// NewRecordingExecutor creates a RecordingExecutor that writes to path
+func NewRecordingExecutor(executor CommandExecutor, path string) *RecordingExecutor {
+	return &RecordingExecutor{Executor: executor, Path: path}
+}
+
+// Run executes and records a command
+func (r *RecordingExecutor) Run(name string, args ...string) RunResult {
+	return r.RunContext(context.Background(), Cmd{Name: name, Args: args})
+}
+
+// RunContext executes and records a command. Stdin is read up front so it
+// can be recorded.
+func (r *RecordingExecutor) RunContext(ctx context.Context, cmd Cmd) RunResult {
+	var stdin string
+	if cmd.Stdin != nil {
+		data, err := io.ReadAll(cmd.Stdin)
+		if err != nil {
+			return RunResult{Success: false, Error: err, ExitCode: -1}
+		}
+		stdin = string(data)
+		cmd.Stdin = bytes.NewReader(data)
+	}
+
+	result := r.Executor.RunContext(ctx, cmd)
+
+	redactor := redactorOrDefault(r.Redactor)
+	interaction := Interaction{
+		Name:     cmd.Name,
+		Args:     redactor.Strings(cmd.Args),
+		Dir:      cmd.Dir,
+		Env:      redactor.Strings(cmd.Env),
+		Stdin:    redactor.String(stdin),
+		Sudo:     cmd.Sudo,
+		Success:  result.Success,
+		Stdout:   redactor.String(result.Stdout),
+		Stderr:   redactor.String(result.Stderr),
+		ExitCode: result.ExitCode,
+		Duration: result.Duration,
+	}
+	if result.Error != nil {
+		interaction.Error = redactor.String(result.Error.Error())
+	}
+	r.record(interaction)
+	return result
+}
+
+// redactorOrDefault returns r, or redact.Default if r is nil
+func redactorOrDefault(r *redact.Redactor) *redact.Redactor {
+	if r != nil {
+		return r
+	}
+	return redact.Default
+}
+
+// LookPath searches PATH through the wrapped executor and records the answer
+func (r *RecordingExecutor) LookPath(cmd string) (string, error) {
+	path, err := r.Executor.LookPath(cmd)
+	interaction := Interaction{LookPath: cmd, Path: path}
+	if err != nil {
+		interaction.Error = err.Error()
+	}
+	r.record(interaction)
+	return path, err
+}
+
+func (r *RecordingExecutor) record(i Interaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, i)
+}
+
+// Cassette returns a copy of what has been recorded so far
+func (r *RecordingExecutor) Cassette() *Cassette {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &Cassette{Interactions: slices.Clone(r.cassette.Interactions)}
+}
+
+// Save writes the recorded interactions to Path
+func (r *RecordingExecutor) Save() error {
+	return r.Cassette().Save(r.Path)
+}
+
+// Close saves the cassette and closes the wrapped executor if it can be
+func (r *RecordingExecutor) Close() error {
+	err := r.Save()
+	if closer, ok := r.Executor.(io.Closer); ok {
+		err = errors.Join(err, closer.Close())
+	}
+	return err
+}
+
+// UnexpectedCommandError is returned by ReplayExecutor for a command that
+// is not in the cassette, or was already replayed as often as recorded
+type UnexpectedCommandError struct {
+	Cmd Cmd
+}
+
+func (e *UnexpectedCommandError) Error() string {
+	return "unexpected command: " + redact.String(e.Cmd.String())
+}
+
+// ReplayExecutor serves results from a cassette without running anything.
+//
+// Each recorded command is replayed once, matched on name, args, dir, env,
+// stdin and sudo, so stages running in parallel may replay in any order.
+// PATH lookups return the last recorded answer for the name and may be
+// repeated. Commands without a match fail with *UnexpectedCommandError.
+// Secrets are masked in commands before they are matched, as they were when
+// the cassette was recorded.
+type ReplayExecutor struct {
+	// Redactor masks secrets in commands before matching. It must mask what
+	// the recording's Redactor did. If nil, redact.Default is used.
+	Redactor *redact.Redactor
+
+	mu         sync.Mutex
+	cassette   *Cassette
+	used       []bool
+	unexpected []string
+}
+
+// NewReplayExecutor creates a ReplayExecutor for a cassette
+func NewReplayExecutor(cassette *Cassette) *ReplayExecutor {
+	return &ReplayExecutor{cassette: cassette, used: make([]bool, len(cassette.Interactions))}
+}
+
+// LoadReplayExecutor creates a ReplayExecutor from a cassette file
+func LoadReplayExecutor(path string) (*ReplayExecutor, error) {
+	cassette, err := LoadCassette(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayExecutor(cassette), nil
+}
+
+// Run replays a command
+func (r *ReplayExecutor) Run(name string, args ...string) RunResult {
+	return r.RunContext(context.Background(), Cmd{Name: name, Args: args})
+}
+
+// RunContext replays the first unused interaction recorded for cmd. Its
+// output is passed to cmd.OnLine as if the command were running.
+func (r *ReplayExecutor) RunContext(ctx context.Context, cmd Cmd) RunResult {
+	var stdin string
+	if cmd.Stdin != nil {
+		data, err := io.ReadAll(cmd.Stdin)
+		if err != nil {
+			return RunResult{Success: false, Error: err, ExitCode: -1}
+		}
+		stdin = string(data)
+	}
+
+	redactor := r.redactor()
+	masked := cmd
+	masked.Args = redactor.Strings(cmd.Args)
+	masked.Env = redactor.Strings(cmd.Env)
+	interaction, ok := r.take(masked, redactor.String(stdin))
+	if !ok {
+		return RunResult{Success: false, Error: &UnexpectedCommandError{Cmd: cmd}, Command: redactor.String(cmd.String()), ExitCode: -1}
+	}
+
+	if cmd.OnLine != nil {
+		stdout, stderr := newLineWriters(cmd.OnLine)
+		stdout.Write([]byte(interaction.Stdout))
+		stderr.Write([]byte(interaction.Stderr))
+		stdout.Flush()
+		stderr.Flush()
+	}
+
+	result := RunResult{
+		Success:  interaction.Success,
+		Command:  redactor.String(cmd.String()),
+		Stdout:   interaction.Stdout,
+		Stderr:   interaction.Stderr,
+		ExitCode: interaction.ExitCode,
+		Duration: interaction.Duration,
+		Elevated: cmd.Sudo,
+	}
+	if interaction.Error != "" {
+		result.Error = errors.New(interaction.Error)
+	}
+	return result
+}
+
+func (r *ReplayExecutor) redactor() *redact.Redactor {
+	return redactorOrDefault(r.Redactor)
+}
+
+// take marks the first unused interaction matching cmd as used
+func (r *ReplayExecutor) take(cmd Cmd, stdin string) (Interaction, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, interaction := range r.cassette.Interactions {
+		if !r.used[i] && interaction.matches(cmd, stdin) {
+			r.used[i] = true
+			return interaction, true
+		}
+	}
+	r.unexpected = append(r.unexpected, r.redactor().String(cmd.String()))
+	return Interaction{}, false
+}
+
+// LookPath returns the recorded answer for a PATH lookup
+func (r *ReplayExecutor) LookPath(cmd string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	found := -1
+	for i, interaction := range r.cassette.Interactions {
+		if interaction.LookPath == cmd {
+			r.used[i] = true
+			found = i
+		}
+	}
+	if found < 0 {
+		r.unexpected = append(r.unexpected, "LookPath("+cmd+")")
+		return "", &CommandNotFoundError{Cmd: cmd}
+	}
+	if r.cassette.Interactions[found].Error != "" {
+		return "", &CommandNotFoundError{Cmd: cmd}
+	}
+	return r.cassette.Interactions[found].Path, nil
+}
+
+// AssertExpectations fails the test if unexpected commands were run or if
+// recorded commands were never replayed
+func (r *ReplayExecutor) AssertExpectations(t mock.TestingT) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ok := true
+	if len(r.unexpected) > 0 {
+		t.Errorf("unexpected commands not in cassette:\n\t%s", strings.Join(r.unexpected, "\n\t"))
+		ok = false
+	}
+	var unused []string
+	for i, interaction := range r.cassette.Interactions {
+		if !r.used[i] {
+			unused = append(unused, interaction.describe())
+		}
+	}
+	if len(unused) > 0 {
+		t.Errorf("recorded commands that were not replayed:\n\t%s", strings.Join(unused, "\n\t"))
+		ok = false
+	}
+	return ok
+}
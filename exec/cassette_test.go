@@ -0,0 +1,110 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cwood/dotgraph/redact"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordingExecutor_Replay(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bootstrap.json")
+
+	recorder := NewRecordingExecutor(&RealExecutor{LogDir: dir}, path)
+	recorder.RunContext(context.Background(), Cmd{Name: "sh", Args: []string{"-c", "echo out; echo err >&2"}, Env: []string{"A=1"}})
+	recorder.Run("sh", "-c", "exit 3")
+	_, lookErr := recorder.LookPath("nonexistent-command-12345")
+	require.Error(t, lookErr)
+	require.NoError(t, recorder.Close())
+
+	replay, err := LoadReplayExecutor(path)
+	require.NoError(t, err)
+
+	var lines []string
+	ok := replay.RunContext(context.Background(), Cmd{
+		Name:   "sh",
+		Args:   []string{"-c", "echo out; echo err >&2"},
+		Env:    []string{"A=1"},
+		OnLine: func(stream Stream, line string) { lines = append(lines, string(stream)+": "+line) },
+	})
+	failed := replay.Run("sh", "-c", "exit 3")
+	_, lookErr = replay.LookPath("nonexistent-command-12345")
+
+	assert.True(t, ok.Success)
+	assert.Equal(t, "out\n", ok.Stdout)
+	assert.Equal(t, "err\n", ok.Stderr)
+	assert.Equal(t, []string{"stdout: out", "stderr: err"}, lines)
+	assert.False(t, failed.Success)
+	assert.Equal(t, 3, failed.ExitCode)
+	assert.EqualError(t, failed.Error, "exit status 3")
+	assert.Error(t, lookErr)
+	replay.AssertExpectations(t)
+}
+
+func TestReplayExecutor_UnexpectedCommand(t *testing.T) {
+	replay := NewReplayExecutor(&Cassette{Interactions: []Interaction{
+		{Name: "git", Args: []string{"pull"}, Success: true},
+		{Name: "git", Args: []string{"status"}, Success: true},
+	}})
+
+	first := replay.Run("git", "pull")
+	again := replay.Run("git", "pull")
+
+	assert.True(t, first.Success)
+	var unexpected *UnexpectedCommandError
+	require.True(t, errors.As(again.Error, &unexpected))
+	assert.Equal(t, "git pull", unexpected.Cmd.String())
+
+	rt := &recordingT{}
+	assert.False(t, replay.AssertExpectations(rt))
+	require.Len(t, rt.errors, 2)
+	assert.Contains(t, rt.errors[0], "git pull")
+	assert.Contains(t, rt.errors[1], "git status")
+}
+
+// recordingT collects failures instead of failing the test
+type recordingT struct {
+	errors []string
+}
+
+func (r *recordingT) Logf(format string, args ...any) {}
+
+func (r *recordingT) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingT) FailNow() {}
+
+func TestRecordingExecutor_RedactsSecrets(t *testing.T) {
+	dir := t.TempDir()
+	redactor := redact.New()
+	redactor.AddSecret("hunter22")
+	recorder := &RecordingExecutor{Executor: &RealExecutor{LogDir: dir}, Path: filepath.Join(dir, "cassette.json"), Redactor: redactor}
+
+	cmd := Cmd{Name: "sh", Args: []string{"-c", "cat; echo hunter22 >&2; exit 1", "hunter22"}, Env: []string{"TOKEN=hunter22"}}
+	cmd.Stdin = strings.NewReader("password hunter22\n")
+	recorder.RunContext(context.Background(), cmd)
+	require.NoError(t, recorder.Save())
+
+	data, err := os.ReadFile(recorder.Path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "hunter22")
+
+	replay, err := LoadReplayExecutor(recorder.Path)
+	require.NoError(t, err)
+	replay.Redactor = redactor
+	cmd.Stdin = strings.NewReader("password hunter22\n")
+	result := replay.RunContext(context.Background(), cmd)
+
+	assert.False(t, result.Success)
+	assert.Equal(t, "password "+redact.Mask+"\n", result.Stdout)
+	replay.AssertExpectations(t)
+}
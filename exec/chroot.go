@@ -0,0 +1,205 @@
+package exec
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cwood/dotgraph/redact"
+)
+
+// DefaultRootPath is the PATH commands get inside a ChrootExecutor's root
+const DefaultRootPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// ChrootExecutor runs commands inside a root directory, such as an
+// extracted Arch or Ubuntu rootfs, so a graph can be tested without
+// touching the host.
+//
+// Paths under Root in Cmd.Dir, Cmd.Args and Cmd.Env values are translated
+// to their location inside the root, so stages can keep working with host
+// paths: point Request.Env.WorkDir at WorkDir() and file operations done in
+// Go and commands run in the root see the same files.
+//
+// Commands run as root inside the root with a clean environment, so Sudo
+// needs no escalation there.
+type ChrootExecutor struct {
+	// Root is the host directory commands run in
+	Root string
+
+	// Namespace runs commands with unshare(1) in a new user namespace with
+	// the current user mapped to root, so no privileges are needed.
+	// Otherwise chroot(8) is used, elevated with sudo when not root.
+	Namespace bool
+
+	// Home is HOME and the default working directory inside the root. If
+	// empty, /root is used.
+	Home string
+
+	// Env holds extra "KEY=value" variables for every command. PATH
+	// defaults to DefaultRootPath.
+	Env []string
+
+	// Local runs the unshare or chroot processes. If nil, Default() is used.
+	Local CommandExecutor
+}
+
+// NewChrootExecutor creates a ChrootExecutor that uses chroot(8)
+func NewChrootExecutor(root string) *ChrootExecutor {
+	return &ChrootExecutor{Root: root}
+}
+
+// NewNamespaceExecutor creates a ChrootExecutor that uses an unprivileged
+// user namespace
+func NewNamespaceExecutor(root string) *ChrootExecutor {
+	return &ChrootExecutor{Root: root, Namespace: true}
+}
+
+// WorkDir returns the host path of the home directory inside the root, for
+// Request.Env.WorkDir
+func (c *ChrootExecutor) WorkDir() string {
+	return c.HostPath(c.home())
+}
+
+// HostPath returns the host path of a path inside the root
+func (c *ChrootExecutor) HostPath(guest string) string {
+	return filepath.Join(c.Root, filepath.FromSlash(path.Clean("/"+guest)))
+}
+
+// GuestPath returns the location inside the root of a host path under Root.
+// Other paths are returned unchanged.
+func (c *ChrootExecutor) GuestPath(host string) string {
+	root := filepath.Clean(c.Root)
+	if host == root {
+		return "/"
+	}
+	if rel, ok := strings.CutPrefix(host, root+string(filepath.Separator)); ok {
+		return "/" + filepath.ToSlash(rel)
+	}
+	return host
+}
+
+// Run executes a command inside the root
+func (c *ChrootExecutor) Run(name string, args ...string) RunResult {
+	return c.RunContext(context.Background(), Cmd{Name: name, Args: args})
+}
+
+// RunContext executes a command inside the root. Stdin, Timeout, OnLine and
+// PTY apply to the local unshare or chroot process.
+func (c *ChrootExecutor) RunContext(ctx context.Context, cmd Cmd) RunResult {
+	dir := c.home()
+	if cmd.Dir != "" {
+		dir = c.GuestPath(cmd.Dir)
+	}
+	argv := make([]string, 0, len(cmd.Args)+1)
+	argv = append(argv, c.GuestPath(cmd.Name))
+	for _, arg := range cmd.Args {
+		argv = append(argv, c.GuestPath(arg))
+	}
+
+	env := []string{"PATH=" + DefaultRootPath, "HOME=" + c.home()}
+	env = append(env, c.Env...)
+	for _, kv := range cmd.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		env = append(env, key+"="+c.GuestPath(value))
+	}
+
+	local := Cmd{Stdin: cmd.Stdin, Timeout: cmd.Timeout, OnLine: cmd.OnLine, PTY: cmd.PTY, logSection: cmd.logSection}
+	if c.Namespace {
+		local.Name = "unshare"
+		local.Args = []string{"--user", "--map-root-user", "--root=" + c.Root, "--wd=" + dir, "--", "env", "-i"}
+		local.Args = append(local.Args, env...)
+	} else {
+		// chroot starts in /, so change directory with the root's shell
+		local.Name = "chroot"
+		local.Args = append([]string{c.Root, "env", "-i"}, env...)
+		local.Args = append(local.Args, "sh", "-c", `cd "$1" && shift && exec "$@"`, "sh", dir)
+		local.Sudo = os.Geteuid() != 0
+	}
+	local.Args = append(local.Args, argv...)
+
+	result := c.local().RunContext(ctx, local)
+	result.Command = redact.String(c.Root + ": " + strings.Join(argv, " "))
+	result.Elevated = cmd.Sudo
+	return result
+}
+
+// LookPath searches the root's PATH, DefaultRootPath unless Env sets one,
+// and returns the path inside the root. Symbolic links are resolved
+// relative to the root.
+func (c *ChrootExecutor) LookPath(name string) (string, error) {
+	candidates := []string{c.GuestPath(name)}
+	if !strings.Contains(name, "/") {
+		candidates = candidates[:0]
+		for _, dir := range filepath.SplitList(pathFromEnv(c.Env)) {
+			candidates = append(candidates, path.Join(dir, name))
+		}
+	}
+	for _, candidate := range candidates {
+		info, err := os.Stat(c.HostPath(c.resolve(candidate)))
+		if err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0 {
+			return candidate, nil
+		}
+	}
+	return "", &CommandNotFoundError{Cmd: name}
+}
+
+// maxSymlinks is how many links resolve follows before giving up
+const maxSymlinks = 40
+
+// resolve follows symbolic links in a path inside the root, treating
+// absolute link targets as relative to the root. It returns the resolved
+// path inside the root.
+func (c *ChrootExecutor) resolve(guest string) string {
+	resolved := "/"
+	remaining := strings.Split(strings.Trim(path.Clean("/"+guest), "/"), "/")
+	for links := 0; len(remaining) > 0; {
+		part := remaining[0]
+		remaining = remaining[1:]
+		if part == "" {
+			continue
+		}
+		next := path.Join(resolved, part)
+
+		target, err := os.Readlink(c.HostPath(next))
+		if err != nil {
+			// Not a link, or missing
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return next
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+		resolved = "/"
+		remaining = append(strings.Split(strings.Trim(path.Clean(target), "/"), "/"), remaining...)
+	}
+	return resolved
+}
+
+func (c *ChrootExecutor) home() string {
+	if c.Home != "" {
+		return c.Home
+	}
+	return "/root"
+}
+
+func (c *ChrootExecutor) local() CommandExecutor {
+	if c.Local != nil {
+		return c.Local
+	}
+	return Default()
+}
+
+// pathFromEnv returns the PATH set in env, or DefaultRootPath
+func pathFromEnv(env []string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if value, ok := strings.CutPrefix(env[i], "PATH="); ok {
+			return value
+		}
+	}
+	return DefaultRootPath
+}
@@ -0,0 +1,156 @@
+package exec
+
+import (
+	"context"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChrootExecutor_LookPath(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "usr", "bin"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "etc", "alternatives"), 0755))
+	require.NoError(t, os.Symlink("usr/bin", filepath.Join(root, "bin")))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "usr", "bin", "git"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "usr", "bin", "README"), []byte("not a program\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "usr", "bin", "vim.basic"), []byte("#!/bin/sh\n"), 0755))
+	// Absolute links point inside the root, not at the host
+	require.NoError(t, os.Symlink("/usr/bin/vim.basic", filepath.Join(root, "etc", "alternatives", "vi")))
+	require.NoError(t, os.Symlink("/etc/alternatives/vi", filepath.Join(root, "usr", "bin", "vi")))
+	require.NoError(t, os.Symlink("/usr/bin/missing", filepath.Join(root, "usr", "bin", "broken")))
+
+	c := NewNamespaceExecutor(root)
+
+	path, err := c.LookPath("git")
+	require.NoError(t, err)
+	assert.Equal(t, "/usr/bin/git", path)
+
+	path, err = c.LookPath("vi")
+	require.NoError(t, err)
+	assert.Equal(t, "/usr/bin/vi", path)
+
+	path, err = c.LookPath("/bin/git")
+	require.NoError(t, err)
+	assert.Equal(t, "/bin/git", path)
+
+	for _, name := range []string{"README", "broken", "sh"} {
+		_, err = c.LookPath(name)
+		assert.Equal(t, &CommandNotFoundError{Cmd: name}, err, name)
+	}
+}
+
+func TestChrootExecutor_RunContext_Namespace(t *testing.T) {
+	root := t.TempDir()
+	local := new(MockExecutor)
+	local.ExpectRunContextSuccess(Cmd{
+		Name: "unshare",
+		Args: []string{
+			"--user", "--map-root-user", "--root=" + root, "--wd=/root/dotfiles", "--",
+			"env", "-i", "PATH=" + DefaultRootPath, "HOME=/root", "LANG=C", "DOTFILES=/root/dotfiles",
+			"git", "clone", "https://example.com/dots.git", "/root/dotfiles",
+		},
+	})
+	c := &ChrootExecutor{Root: root, Namespace: true, Env: []string{"LANG=C"}, Local: local}
+	dotfiles := filepath.Join(c.WorkDir(), "dotfiles")
+
+	result := c.RunContext(context.Background(), Cmd{
+		Name: "git",
+		Args: []string{"clone", "https://example.com/dots.git", dotfiles},
+		Dir:  dotfiles,
+		Env:  []string{"DOTFILES=" + dotfiles},
+	})
+
+	assert.True(t, result.Success)
+	assert.Equal(t, root+": git clone https://example.com/dots.git /root/dotfiles", result.Command)
+	local.AssertExpectations(t)
+}
+
+func TestChrootExecutor_RunContext_Chroot(t *testing.T) {
+	root := t.TempDir()
+	local := new(MockExecutor)
+	local.ExpectCmd(RunResult{Success: true},
+		MatchName("chroot"),
+		MatchArgs(root, "env", "-i", "PATH="+DefaultRootPath, "HOME=/root",
+			"sh", "-c", `cd "$1" && shift && exec "$@"`, "sh", "/root",
+			"pacman", "-S", "git"),
+		MatchSudo(os.Geteuid() != 0),
+	)
+	c := &ChrootExecutor{Root: root, Local: local}
+
+	result := c.RunContext(context.Background(), Cmd{Name: "pacman", Args: []string{"-S", "git"}, Sudo: true})
+
+	assert.True(t, result.Success)
+	assert.True(t, result.Elevated)
+	local.AssertExpectations(t)
+}
+
+func TestChrootExecutor_Paths(t *testing.T) {
+	c := NewChrootExecutor("/srv/rootfs")
+
+	assert.Equal(t, "/srv/rootfs/root", c.WorkDir())
+	assert.Equal(t, "/srv/rootfs/etc/passwd", c.HostPath("/etc/../etc/passwd"))
+	assert.Equal(t, "/etc/passwd", c.GuestPath("/srv/rootfs/etc/passwd"))
+	assert.Equal(t, "/", c.GuestPath("/srv/rootfs"))
+	assert.Equal(t, "/srv/rootfs2/x", c.GuestPath("/srv/rootfs2/x"))
+}
+
+func TestNamespaceExecutor_RunContext(t *testing.T) {
+	if err := osexec.Command("unshare", "--user", "--map-root-user", "true").Run(); err != nil {
+		t.Skipf("unshare --user is not available: %v", err)
+	}
+	root := minimalRoot(t, "env", "pwd")
+	c := NewNamespaceExecutor(root)
+	c.Env = []string{"LANG=C"}
+	c.Local = &RealExecutor{LogDir: t.TempDir()}
+	dotfiles := filepath.Join(c.WorkDir(), "dotfiles")
+	require.NoError(t, os.MkdirAll(dotfiles, 0755))
+
+	result := c.RunContext(context.Background(), Cmd{Name: "pwd", Dir: dotfiles})
+	require.True(t, result.Success, result.Stderr)
+	assert.Equal(t, "/root/dotfiles\n", result.Stdout)
+
+	result = c.RunContext(context.Background(), Cmd{Name: "env", Env: []string{"DOTFILES=" + dotfiles}})
+	require.True(t, result.Success, result.Stderr)
+	assert.Equal(t, "PATH="+DefaultRootPath+"\nHOME=/root\nLANG=C\nDOTFILES=/root/dotfiles\n", result.Stdout)
+}
+
+// lddPath matches the libraries ldd lists for a program
+var lddPath = regexp.MustCompile(`(?m)(/\S+) \(0x`)
+
+// minimalRoot builds a root with the host's programs and the shared
+// libraries they load, skipping the test when they cannot be found
+func minimalRoot(t *testing.T, programs ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "root"), 0755))
+
+	var files []string
+	for _, program := range programs {
+		path, err := osexec.LookPath(program)
+		if err != nil {
+			t.Skipf("%s is not installed: %v", program, err)
+		}
+		out, err := osexec.Command("ldd", path).Output()
+		if err != nil {
+			t.Skipf("ldd %s: %v", path, err)
+		}
+		files = append(files, path)
+		for _, m := range lddPath.FindAllStringSubmatch(string(out), -1) {
+			files = append(files, m[1])
+		}
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		dest := filepath.Join(root, file)
+		require.NoError(t, os.MkdirAll(filepath.Dir(dest), 0755))
+		require.NoError(t, os.WriteFile(dest, data, 0755))
+	}
+	return root
+}
@@ -0,0 +1,70 @@
+package exec
+
+import (
+	"io"
+	"strings"
+	"time"
+)
+
+// Cmd describes a command to run with RunContext
+type Cmd struct {
+	// Name is the program to run, looked up in PATH if it has no slash
+	Name string
+
+	// Args are the arguments passed to the program
+	Args []string
+
+	// Dir is the working directory. If empty, the current directory is used.
+	Dir string
+
+	// Env holds extra environment variables in "KEY=value" form. They are
+	// added to the executor's environment, overriding existing values.
+	Env []string
+
+	// Stdin is connected to the command's standard input if non-nil
+	Stdin io.Reader
+
+	// Timeout stops the command once it has run this long. Zero means no
+	// timeout beyond the context's own deadline.
+	Timeout time.Duration
+
+	// Sudo runs the command as root through the executor's Escalator
+	Sudo bool
+
+	// OnLine, if set, receives output line by line while the command runs.
+	// Output is still captured in RunResult and the failure log.
+	OnLine LineHandler
+
+	// PTY runs the command under a pseudo-terminal connected to the user's
+	// terminal, for tools that prompt or change behaviour without a TTY.
+	// Stdout and stderr are merged. It is ignored when Stdin is set or the
+	// process's stdin is not a terminal.
+	PTY bool
+
+	// logSection, if set, writes an extra section at the end of the failure
+	// log, such as the numbered script RunScriptContext ran
+	logSection func(w io.Writer, result RunResult)
+}
+
+// String returns the command line, for logs and error messages. Elevated
+// commands are shown as run through the escalator DetectEscalator picks.
+func (c Cmd) String() string {
+	return c.Format(defaultEscalator())
+}
+
+// Format returns the command line as esc would run it
+func (c Cmd) Format(esc Escalator) string {
+	return strings.Join(c.argv(esc), " ")
+}
+
+// argv returns the full argument vector, wrapped by esc if the command is
+// elevated
+func (c Cmd) argv(esc Escalator) []string {
+	argv := make([]string, 0, len(c.Args)+1)
+	argv = append(argv, c.Name)
+	argv = append(argv, c.Args...)
+	if c.Sudo {
+		return esc.wrap(argv, c.Env)
+	}
+	return argv
+}
@@ -0,0 +1,197 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Environment is the set of environment variables commands run with. It
+// starts as a snapshot and changes as a run installs software, so later
+// stages find commands in directories added to PATH by earlier ones. It is
+// safe for concurrent use, and the zero value is an empty environment.
+type Environment struct {
+	mu   sync.RWMutex
+	vars map[string]string
+}
+
+// NewEnvironment creates an Environment from "KEY=value" entries. Later
+// entries override earlier ones.
+func NewEnvironment(environ []string) *Environment {
+	vars := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		if key, value, ok := strings.Cut(kv, "="); ok {
+			vars[key] = value
+		}
+	}
+	return &Environment{vars: vars}
+}
+
+// SnapshotEnvironment creates an Environment from the current process
+// environment
+func SnapshotEnvironment() *Environment {
+	return NewEnvironment(os.Environ())
+}
+
+// Get returns the value of a variable and whether it is set
+func (e *Environment) Get(key string) (string, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	value, ok := e.vars[key]
+	return value, ok
+}
+
+// Set sets a variable
+func (e *Environment) Set(key, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.vars == nil {
+		e.vars = make(map[string]string)
+	}
+	e.vars[key] = value
+}
+
+// Unset removes a variable
+func (e *Environment) Unset(key string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.vars, key)
+}
+
+// Environ returns the variables in "KEY=value" form, sorted by key
+func (e *Environment) Environ() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	environ := make([]string, 0, len(e.vars))
+	for _, key := range slices.Sorted(maps.Keys(e.vars)) {
+		environ = append(environ, key+"="+e.vars[key])
+	}
+	return environ
+}
+
+// Path returns the directories in PATH
+func (e *Environment) Path() []string {
+	value, _ := e.Get("PATH")
+	return filepath.SplitList(value)
+}
+
+// PrependPath puts dirs at the front of PATH, in the order given. Dirs
+// already in PATH are moved.
+func (e *Environment) PrependPath(dirs ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	path := slices.DeleteFunc(filepath.SplitList(e.vars["PATH"]), func(dir string) bool {
+		return slices.Contains(dirs, dir)
+	})
+	e.setPath(append(slices.Compact(slices.Clone(dirs)), path...))
+}
+
+// AppendPath adds dirs to the end of PATH. Dirs already in PATH stay where
+// they are.
+func (e *Environment) AppendPath(dirs ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	path := filepath.SplitList(e.vars["PATH"])
+	for _, dir := range dirs {
+		if !slices.Contains(path, dir) {
+			path = append(path, dir)
+		}
+	}
+	e.setPath(path)
+}
+
+func (e *Environment) setPath(dirs []string) {
+	if e.vars == nil {
+		e.vars = make(map[string]string)
+	}
+	e.vars["PATH"] = strings.Join(dirs, string(filepath.ListSeparator))
+}
+
+// LookPath searches PATH for an executable
+func (e *Environment) LookPath(name string) (string, error) {
+	if strings.Contains(name, string(filepath.Separator)) {
+		return exec.LookPath(name)
+	}
+	for _, dir := range e.Path() {
+		if dir == "" {
+			// Like the shell, an empty entry means the working directory
+			dir = "."
+		}
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			if !filepath.IsAbs(path) {
+				return path, &exec.Error{Name: name, Err: exec.ErrDot}
+			}
+			return path, nil
+		}
+	}
+	return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+}
+
+// ignoredShellVars are set by the shell itself and not carried over by Reload
+var ignoredShellVars = []string{"_", "PWD", "OLDPWD", "SHLVL"}
+
+// Reload replaces the variables with those of a login shell started with
+// the current environment, so changes made by profile scripts, such as
+// `eval "$(brew shellenv)"` in ~/.zprofile, take effect. If shell is empty,
+// $SHELL is used, falling back to /bin/sh.
+func (e *Environment) Reload(ctx context.Context, shell string) error {
+	if shell == "" {
+		shell, _ = e.Get("SHELL")
+	}
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, shell, "-l", "-c", "env -0")
+	cmd.Env = e.Environ()
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := lastLine(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return fmt.Errorf("reload environment from %s: %w", shell, err)
+	}
+
+	environ := strings.Split(strings.TrimSuffix(stdout.String(), "\x00"), "\x00")
+	vars := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		key, value, ok := strings.Cut(kv, "=")
+		if ok && !slices.Contains(ignoredShellVars, key) {
+			vars[key] = value
+		}
+	}
+	if _, ok := vars["PATH"]; !ok {
+		return fmt.Errorf("reload environment from %s: no PATH in output", shell)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.vars = vars
+	return nil
+}
+
+// EnvironmentOwner is implemented by executors that run commands with an
+// Environment of their own
+type EnvironmentOwner interface {
+	Environment() *Environment
+}
+
+// EnvironmentOf returns the Environment executor runs commands with, or
+// nil if it uses the process environment or does not say
+func EnvironmentOf(executor CommandExecutor) *Environment {
+	if owner, ok := executor.(EnvironmentOwner); ok {
+		return owner.Environment()
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package exec
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeProgram writes an executable shell script
+func writeProgram(t *testing.T, path, script string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755))
+}
+
+func TestEnvironment(t *testing.T) {
+	env := NewEnvironment([]string{"HOME=/home/me", "PATH=/usr/bin:/bin", "EDITOR=vi", "EDITOR=nvim", "bogus"})
+	env.Set("LANG", "C")
+	env.Unset("HOME")
+
+	editor, ok := env.Get("EDITOR")
+	assert.True(t, ok)
+	assert.Equal(t, "nvim", editor)
+	_, ok = env.Get("HOME")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"EDITOR=nvim", "LANG=C", "PATH=/usr/bin:/bin"}, env.Environ())
+}
+
+func TestEnvironment_Path(t *testing.T) {
+	env := NewEnvironment([]string{"PATH=/usr/bin:/bin:/opt/homebrew/bin"})
+
+	env.PrependPath("/opt/homebrew/bin", "/opt/homebrew/sbin")
+	assert.Equal(t, []string{"/opt/homebrew/bin", "/opt/homebrew/sbin", "/usr/bin", "/bin"}, env.Path())
+
+	env.AppendPath("/usr/bin", "/home/me/.cargo/bin")
+	assert.Equal(t, []string{"/opt/homebrew/bin", "/opt/homebrew/sbin", "/usr/bin", "/bin", "/home/me/.cargo/bin"}, env.Path())
+}
+
+func TestEnvironment_ZeroValue(t *testing.T) {
+	var env Environment
+
+	env.AppendPath("/usr/bin")
+	env.PrependPath("/opt/homebrew/bin")
+	env.Set("LANG", "C")
+
+	assert.Equal(t, []string{"LANG=C", "PATH=/opt/homebrew/bin:/usr/bin"}, env.Environ())
+}
+
+func TestEnvironment_LookPath(t *testing.T) {
+	dir := t.TempDir()
+	writeProgram(t, filepath.Join(dir, "bin", "hello"), "echo hello")
+	env := NewEnvironment([]string{"PATH=/nonexistent"})
+
+	_, err := env.LookPath("hello")
+	assert.Error(t, err)
+
+	env.AppendPath(filepath.Join(dir, "bin"))
+	path, err := env.LookPath("hello")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "bin", "hello"), path)
+}
+
+func TestEnvironment_Reload(t *testing.T) {
+	shell := filepath.Join(t.TempDir(), "shell")
+	writeProgram(t, shell, `[ "$1" = -l ] || exit 2
+export PATH="/opt/homebrew/bin:$PATH" HOMEBREW_PREFIX=/opt/homebrew SHLVL=2
+exec env -0`)
+	env := NewEnvironment([]string{"PATH=/usr/bin:/bin", "KEPT=yes"})
+
+	require.NoError(t, env.Reload(context.Background(), shell))
+
+	assert.Equal(t, []string{"HOMEBREW_PREFIX=/opt/homebrew", "KEPT=yes", "PATH=/opt/homebrew/bin:/usr/bin:/bin"}, env.Environ())
+}
+
+func TestEnvironment_Reload_Failure(t *testing.T) {
+	shell := filepath.Join(t.TempDir(), "shell")
+	writeProgram(t, shell, "echo 'profile: syntax error' >&2; exit 1")
+	env := NewEnvironment([]string{"PATH=/usr/bin:/bin"})
+
+	err := env.Reload(context.Background(), shell)
+
+	assert.ErrorContains(t, err, "profile: syntax error")
+	assert.Equal(t, []string{"PATH=/usr/bin:/bin"}, env.Environ())
+}
+
+func TestRealExecutor_Env(t *testing.T) {
+	dir := t.TempDir()
+	writeProgram(t, filepath.Join(dir, "bin", "greet"), `echo "$GREETING"`)
+	env := NewEnvironment([]string{"PATH=/usr/bin:/bin", "GREETING=hi"})
+	executor := Chain(&RealExecutor{LogDir: t.TempDir(), Env: env}, Audit(slog.New(slog.DiscardHandler)))
+
+	_, err := executor.LookPath("greet")
+	assert.Error(t, err)
+
+	EnvironmentOf(executor).PrependPath(filepath.Join(dir, "bin"))
+	_, err = executor.LookPath("greet")
+	require.NoError(t, err)
+
+	result := executor.RunContext(context.Background(), Cmd{Name: "greet", Env: []string{"GREETING=hello"}})
+	require.True(t, result.Success, result.Error)
+	assert.Equal(t, "hello\n", result.Stdout)
+}
@@ -0,0 +1,145 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Escalator runs commands as root through a program such as sudo or doas
+type Escalator struct {
+	// Program is the escalation command. If empty, elevated commands run
+	// unchanged, which only works when already running as root.
+	Program string
+
+	// Args are placed between Program and the command
+	Args []string
+
+	// PreserveEnv, if set, is the option that keeps variables of the
+	// caller's environment, e.g. "--preserve-env=". The names in Cmd.Env are
+	// appended to it and their values passed in the process environment, so
+	// secrets stay off the command line. Without it, Cmd.Env is passed
+	// through env(1) as arguments, which other users can see in ps.
+	PreserveEnv string
+
+	// PrimeArgs are run once, before the first elevated command, so the user
+	// is asked for credentials up front instead of in the middle of the
+	// command's output. Nil skips priming.
+	PrimeArgs []string
+
+	// KeepAlive is how often the priming command is repeated
+	// non-interactively so cached credentials do not expire during a long
+	// run. Zero disables it.
+	KeepAlive time.Duration
+}
+
+var (
+	// SudoEscalator elevates with sudo and keeps its timestamp fresh
+	SudoEscalator = Escalator{Program: "sudo", Args: []string{"--"}, PreserveEnv: "--preserve-env=", PrimeArgs: []string{"-v"}, KeepAlive: time.Minute}
+
+	// DoasEscalator elevates with doas. Credentials are only cached if
+	// doas.conf uses the persist option.
+	DoasEscalator = Escalator{Program: "doas", PrimeArgs: []string{"true"}}
+
+	// NoEscalator runs elevated commands as the current user
+	NoEscalator = Escalator{}
+)
+
+// defaultEscalator is DetectEscalator's choice, detected once
+var defaultEscalator = sync.OnceValue(DetectEscalator)
+
+// EscalatorOf returns the Escalator executor elevates commands with: a
+// RealExecutor's configured one, also through middleware, or else
+// DetectEscalator's choice
+func EscalatorOf(executor CommandExecutor) Escalator {
+	if e, ok := executor.(interface{ escalator() Escalator }); ok {
+		return e.escalator()
+	}
+	return defaultEscalator()
+}
+
+// DetectEscalator returns NoEscalator when running as root, otherwise
+// SudoEscalator or DoasEscalator, whichever is found in PATH first
+func DetectEscalator() Escalator {
+	if os.Geteuid() == 0 {
+		return NoEscalator
+	}
+	for _, e := range []Escalator{SudoEscalator, DoasEscalator} {
+		if _, err := exec.LookPath(e.Program); err == nil {
+			return e
+		}
+	}
+	return NoEscalator
+}
+
+// wrap returns the argument vector that runs argv as root. The escalation
+// program resets the environment, so env is named in the PreserveEnv option
+// or else passed through env(1).
+func (e Escalator) wrap(argv, env []string) []string {
+	if e.Program == "" {
+		return argv
+	}
+	wrapped := make([]string, 0, len(e.Args)+len(env)+len(argv)+3)
+	wrapped = append(wrapped, e.Program)
+	if len(env) > 0 && e.PreserveEnv != "" {
+		names := make([]string, len(env))
+		for i, kv := range env {
+			names[i], _, _ = strings.Cut(kv, "=")
+		}
+		wrapped = append(wrapped, e.PreserveEnv+strings.Join(names, ","))
+	}
+	wrapped = append(wrapped, e.Args...)
+	if len(env) > 0 && e.PreserveEnv == "" {
+		wrapped = append(wrapped, "env")
+		wrapped = append(wrapped, env...)
+	}
+	return append(wrapped, argv...)
+}
+
+// envOnCommandLine reports whether wrap passes the Env of elevated
+// commands as arguments rather than in the process environment
+func (e Escalator) envOnCommandLine() bool {
+	return e.Program != "" && e.PreserveEnv == ""
+}
+
+// usable reports an error if the escalator cannot run commands as root
+func (e Escalator) usable() error {
+	if e.Program == "" && os.Geteuid() != 0 {
+		return fmt.Errorf("not running as root and no sudo or doas available")
+	}
+	return nil
+}
+
+// prime asks for credentials on the user's terminal, or checks that none
+// are needed when there is no terminal
+func (e Escalator) prime(ctx context.Context) error {
+	if !stdinIsTerminal() {
+		out, err := exec.CommandContext(ctx, e.Program, append([]string{"-n"}, e.PrimeArgs...)...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s needs a password but stdin is not a terminal: %s", e.Program, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, e.Program, e.PrimeArgs...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", e.Program, err)
+	}
+	return nil
+}
+
+// refresh repeats the priming command without prompting
+func (e Escalator) refresh(ctx context.Context) error {
+	return exec.CommandContext(ctx, e.Program, append([]string{"-n"}, e.PrimeArgs...)...).Run()
+}
+
+// stdinIsTerminal reports whether the process's stdin is a character device
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -1,66 +1,44 @@
 package exec
 
-import (
-	"bytes"
-	"fmt"
-	"log"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"time"
+import "sync"
+
+var (
+	defaultMu       sync.RWMutex
+	defaultExecutor CommandExecutor
 )
 
-var logDir string
+// Default returns the executor used by the package-level Run functions.
+// Unless replaced with SetDefault, it is a RealExecutor created on first use.
+func Default() CommandExecutor {
+	defaultMu.RLock()
+	executor := defaultExecutor
+	defaultMu.RUnlock()
+	if executor != nil {
+		return executor
+	}
 
-func init() {
-	// Create log directory in user's home
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		logDir = "/tmp/bootstrap-logs"
-	} else {
-		logDir = filepath.Join(homeDir, ".cache", "bootstrap-logs")
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultExecutor == nil {
+		defaultExecutor = NewRealExecutor()
 	}
-	os.MkdirAll(logDir, 0755)
+	return defaultExecutor
 }
 
-// RunResult contains the result of running a command
-type RunResult struct {
-	Success bool
-	LogFile string
-	Error   error
+// SetDefault replaces the executor returned by Default, e.g. with a mock in
+// tests or an executor wrapped in middleware. Passing nil restores a new
+// RealExecutor on next use.
+func SetDefault(executor CommandExecutor) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultExecutor = executor
 }
 
-// Run executes a command and captures output
+// Run executes a command with the Default executor
 // On success: returns success with no log file
 // On failure: writes output to log file and returns path
 func Run(name string, arg ...string) RunResult {
-	cmd := exec.Command(name, arg...)
-	
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-
-	if err != nil {
-		// Write failure log
-		timestamp := time.Now().Format("20060102-150405")
-		logFile := filepath.Join(logDir, fmt.Sprintf("%s-%s.log", name, timestamp))
-		
-		logContent := fmt.Sprintf("Command: %s %v\n", name, arg)
-		logContent += fmt.Sprintf("Exit Code: %v\n", err)
-		logContent += fmt.Sprintf("\n=== STDOUT ===\n%s\n", stdout.String())
-		logContent += fmt.Sprintf("\n=== STDERR ===\n%s\n", stderr.String())
-		
-		if writeErr := os.WriteFile(logFile, []byte(logContent), 0644); writeErr != nil {
-			log.Printf("Failed to write log file: %v", writeErr)
-			return RunResult{Success: false, Error: err}
-		}
-		
-		return RunResult{Success: false, LogFile: logFile, Error: err}
-	}
-
-	return RunResult{Success: true}
+	return Default().Run(name, arg...)
 }
 
 // RunQuiet executes a command silently, logging to file on error
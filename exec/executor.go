@@ -1,13 +1,17 @@
 package exec
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/cwood/dotgraph/redact"
 )
 
 // CommandExecutor defines the interface for running commands
@@ -15,61 +19,378 @@ type CommandExecutor interface {
 	// Run executes a command and returns the result
 	Run(name string, args ...string) RunResult
 
+	// RunContext executes a command that is stopped when ctx is done
+	RunContext(ctx context.Context, cmd Cmd) RunResult
+
 	// LookPath searches for an executable in PATH
 	LookPath(cmd string) (string, error)
 }
 
 // RealExecutor implements CommandExecutor using os/exec
 type RealExecutor struct {
-	// LogDir is the directory where failure logs are written
-	// If empty, defaults to ~/.cache/bootstrap-logs or /tmp/bootstrap-logs
+	// Logs stores failure logs. If nil, a LogStore in LogDir is used, or
+	// DefaultLogStore if LogDir is empty too.
+	Logs *LogStore
+
+	// LogDir is the directory where failure logs are written when Logs is nil
 	LogDir string
+
+	// GracePeriod is how long a cancelled command has to exit after SIGTERM
+	// before its process group is killed. If zero, DefaultGracePeriod is used.
+	GracePeriod time.Duration
+
+	// MaxOutput is how many bytes of stdout and stderr each are kept in
+	// memory. Longer output spills to a temporary file that is copied into
+	// the failure log, and RunResult keeps only its last TailOutput bytes.
+	// If zero, DefaultMaxOutput is used.
+	MaxOutput int
+
+	// TailOutput is how many bytes at the end of spilled output are kept in
+	// RunResult. If zero, DefaultTailOutput is used.
+	TailOutput int
+
+	// PTY runs every command as if Cmd.PTY were set
+	PTY bool
+
+	// Redactor masks secrets in failure logs, streamed output and
+	// RunResult.Command. If nil, redact.Default is used.
+	Redactor *redact.Redactor
+
+	// Escalator runs commands with Sudo set. If nil, DetectEscalator is
+	// used. Credentials are primed before the first elevated command and
+	// kept alive until Close is called.
+	Escalator *Escalator
+
+	// Env is the environment commands run with and LookPath searches. If
+	// nil, the process environment is used.
+	Env *Environment
+
+	// Policy, if set, rejects the commands it does not permit with a
+	// *PolicyViolationError before they start
+	Policy *Policy
+
+	storeOnce     sync.Once
+	store         *LogStore
+	detectOnce    sync.Once
+	detected      Escalator
+	primeMu       sync.Mutex
+	primed        bool
+	mu            sync.Mutex
+	stopKeepAlive context.CancelFunc
 }
 
-// NewRealExecutor creates a new RealExecutor with default log directory
+// DefaultGracePeriod is the time between SIGTERM and SIGKILL when a
+// command's context is cancelled
+const DefaultGracePeriod = 5 * time.Second
+
+// NewRealExecutor creates a new RealExecutor that writes failure logs to
+// DefaultLogStore and runs commands with a snapshot of the process
+// environment
 func NewRealExecutor() *RealExecutor {
-	logDir := "/tmp/bootstrap-logs"
-	if homeDir, err := os.UserHomeDir(); err == nil {
-		logDir = filepath.Join(homeDir, ".cache", "bootstrap-logs")
-	}
-	os.MkdirAll(logDir, 0755)
-	return &RealExecutor{LogDir: logDir}
+	return &RealExecutor{Logs: DefaultLogStore(), Env: SnapshotEnvironment()}
 }
 
 // Run executes a command and captures output
 // On success: returns success with no log file
 // On failure: writes output to log file and returns path
 func (r *RealExecutor) Run(name string, args ...string) RunResult {
-	cmd := exec.Command(name, args...)
+	return r.RunContext(context.Background(), Cmd{Name: name, Args: args})
+}
+
+// RunContext executes a command like Run. When ctx is done or the command's
+// Timeout expires, its whole process group receives SIGTERM, followed by
+// SIGKILL after the grace period. If the command has an OnLine handler,
+// output is streamed to it as well as captured.
+func (r *RealExecutor) RunContext(ctx context.Context, c Cmd) RunResult {
+	esc := r.escalator()
+	if r.Policy != nil {
+		if err := r.Policy.Check(c); err != nil {
+			return RunResult{Error: err, Command: r.redactor().String(c.Format(esc)), ExitCode: -1, Elevated: c.Sudo}
+		}
+	}
+
+	// Priming may wait for a password, which the command's Timeout is not
+	// meant to cover
+	if c.Sudo {
+		if err := r.elevate(ctx, esc); err != nil {
+			return RunResult{Error: err, Command: r.redactor().String(c.Format(esc)), ExitCode: -1, Elevated: true}
+		}
+	}
 
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	argv := c.argv(esc)
+	program := argv[0]
+	if r.Env != nil {
+		// exec.Command would search the process PATH
+		if path, err := r.Env.LookPath(program); err == nil {
+			program = path
+		}
+	}
+	cmd := exec.CommandContext(ctx, program, argv[1:]...)
+	cmd.Args[0] = argv[0]
+	cmd.Dir = c.Dir
+	cmd.Env = r.environ(c, esc)
+	cmd.Stdin = c.Stdin
+	cleanup := setProcessGroup(cmd, r.gracePeriod())
+	defer cleanup()
 
-	err := cmd.Run()
+	stdout := newSpillBuffer(r.maxOutput(), r.tailOutput())
+	stderr := newSpillBuffer(r.maxOutput(), r.tailOutput())
+	defer stdout.Close()
+	defer stderr.Close()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
-	if err != nil {
-		// Write failure log
-		timestamp := time.Now().Format("20060102-150405")
-		logFile := filepath.Join(r.LogDir, fmt.Sprintf("%s-%s.log", name, timestamp))
+	var lineOut, lineErr *lineWriter
+	if c.OnLine != nil {
+		lineOut, lineErr = newLineWriters(redactLines(c.OnLine, r.redactor()))
+		cmd.Stdout = io.MultiWriter(stdout, lineOut)
+		cmd.Stderr = io.MultiWriter(stderr, lineErr)
+	}
 
-		logContent := fmt.Sprintf("Command: %s %v\n", name, args)
-		logContent += fmt.Sprintf("Exit Code: %v\n", err)
-		logContent += fmt.Sprintf("\n=== STDOUT ===\n%s\n", stdout.String())
-		logContent += fmt.Sprintf("\n=== STDERR ===\n%s\n", stderr.String())
+	start := time.Now()
+	var err error
+	if term := r.terminalFor(c); term != nil {
+		err = runPTY(cmd, cmd.Stdout, term)
+	} else {
+		err = cmd.Run()
+	}
+	if c.OnLine != nil {
+		lineOut.Flush()
+		lineErr.Flush()
+	}
+	result := RunResult{
+		Success:  err == nil,
+		Error:    err,
+		Command:  r.redactor().String(strings.Join(argv, " ")),
+		Elevated: c.Sudo,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: -1,
+		Duration: time.Since(start),
+	}
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+		result.Usage = Usage{
+			UserTime:   cmd.ProcessState.UserTime(),
+			SystemTime: cmd.ProcessState.SystemTime(),
+			MaxRSS:     maxRSS(cmd.ProcessState),
+		}
+		StatsFromContext(ctx).addUsage(result.Usage)
+	}
+	if err != nil && ctx.Err() != nil {
+		result.Error = fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
 
-		if writeErr := os.WriteFile(logFile, []byte(logContent), 0644); writeErr != nil {
+	if !result.Success {
+		logFile, writeErr := r.writeFailureLog(ctx, c, result, stdout, stderr)
+		if writeErr != nil {
 			log.Printf("Failed to write log file: %v", writeErr)
-			return RunResult{Success: false, Error: err}
 		}
+		// The log is still there if only pruning old ones failed
+		result.LogFile = logFile
+	}
+
+	return result
+}
+
+// writeFailureLog streams the command and its full output to the log
+// store, attributed to the stage named in ctx
+func (r *RealExecutor) writeFailureLog(ctx context.Context, c Cmd, result RunResult, stdout, stderr io.WriterTo) (string, error) {
+	stage := StageFromContext(ctx)
+	entry := LogEntry{
+		Stage:    stage,
+		Name:     c.Name,
+		Command:  result.Command,
+		ExitCode: result.ExitCode,
+	}
+	if result.Error != nil {
+		entry.Error = r.redactor().String(result.Error.Error())
+	}
+
+	return r.logStore().Write(entry, func(w io.Writer) error {
+		rw := newRedactWriter(w, r.redactor())
+		fmt.Fprintf(rw, "Command: %s\n", result.Command)
+		if stage != "" {
+			fmt.Fprintf(rw, "Stage: %s\n", stage)
+		}
+		if c.Dir != "" {
+			fmt.Fprintf(rw, "Directory: %s\n", c.Dir)
+		}
+		fmt.Fprintf(rw, "Exit Code: %d\n", result.ExitCode)
+		fmt.Fprintf(rw, "Error: %v\n", result.Error)
+		fmt.Fprintf(rw, "Duration: %s\n", result.Duration)
+
+		io.WriteString(rw, "\n=== STDOUT ===\n")
+		if _, err := stdout.WriteTo(rw); err != nil {
+			return err
+		}
+		io.WriteString(rw, "\n\n=== STDERR ===\n")
+		if _, err := stderr.WriteTo(rw); err != nil {
+			return err
+		}
+		io.WriteString(rw, "\n")
+		if c.logSection != nil {
+			c.logSection(rw, result)
+		}
+		return rw.Flush()
+	})
+}
+
+// redactor returns the configured redactor or redact.Default
+func (r *RealExecutor) redactor() *redact.Redactor {
+	return redactorOrDefault(r.Redactor)
+}
+
+// logStore returns the store failure logs are written to
+func (r *RealExecutor) logStore() *LogStore {
+	r.storeOnce.Do(func() {
+		switch {
+		case r.Logs != nil:
+			r.store = r.Logs
+		case r.LogDir != "":
+			r.store = NewLogStore(r.LogDir)
+		default:
+			r.store = DefaultLogStore()
+		}
+	})
+	return r.store
+}
+
+// escalator returns the configured escalator or the detected one
+func (r *RealExecutor) escalator() Escalator {
+	if r.Escalator != nil {
+		return *r.Escalator
+	}
+	r.detectOnce.Do(func() {
+		r.detected = DetectEscalator()
+	})
+	return r.detected
+}
+
+// elevate makes sure esc can run commands as root, priming its credentials
+// until that succeeds once. Concurrent elevated commands wait for the same
+// prompt instead of each showing their own.
+func (r *RealExecutor) elevate(ctx context.Context, esc Escalator) error {
+	if err := esc.usable(); err != nil {
+		return err
+	}
+	if esc.Program == "" || esc.PrimeArgs == nil {
+		return nil
+	}
+	r.primeMu.Lock()
+	defer r.primeMu.Unlock()
+	if r.primed {
+		return nil
+	}
+	if err := esc.prime(ctx); err != nil {
+		return err
+	}
+	r.primed = true
+	if esc.KeepAlive > 0 {
+		r.keepAlive(esc)
+	}
+	return nil
+}
+
+// keepAlive refreshes esc's cached credentials until Close is called
+func (r *RealExecutor) keepAlive(esc Escalator) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.mu.Lock()
+	r.stopKeepAlive = cancel
+	r.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(esc.KeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// A failed refresh only means the next elevated command
+				// may prompt again
+				esc.refresh(ctx)
+			}
+		}
+	}()
+}
 
-		return RunResult{Success: false, LogFile: logFile, Error: err}
+// Close stops the credential keep-alive started by elevated commands
+func (r *RealExecutor) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopKeepAlive != nil {
+		r.stopKeepAlive()
+		r.stopKeepAlive = nil
 	}
+	return nil
+}
 
-	return RunResult{Success: true}
+// terminalFor returns the terminal to attach the command to, or nil if it
+// should run with plain pipes
+func (r *RealExecutor) terminalFor(c Cmd) *terminal {
+	if !ptySupported || !(c.PTY || r.PTY) || c.Stdin != nil {
+		return nil
+	}
+	return userTerminal()
+}
+
+// tailOutput returns the configured tail size or the default
+func (r *RealExecutor) tailOutput() int {
+	if r.TailOutput > 0 {
+		return r.TailOutput
+	}
+	return DefaultTailOutput
+}
+
+// maxOutput returns the configured output cap or the default
+func (r *RealExecutor) maxOutput() int {
+	if r.MaxOutput > 0 {
+		return r.MaxOutput
+	}
+	return DefaultMaxOutput
+}
+
+// gracePeriod returns the configured grace period or the default
+func (r *RealExecutor) gracePeriod() time.Duration {
+	if r.GracePeriod > 0 {
+		return r.GracePeriod
+	}
+	return DefaultGracePeriod
 }
 
 // LookPath searches for an executable in PATH
 func (r *RealExecutor) LookPath(cmd string) (string, error) {
+	if r.Env != nil {
+		return r.Env.LookPath(cmd)
+	}
 	return exec.LookPath(cmd)
 }
+
+// Environment returns Env, implementing EnvironmentOwner
+func (r *RealExecutor) Environment() *Environment {
+	return r.Env
+}
+
+// environ returns the environment for c, or nil to inherit the process
+// environment. Env of commands elevated through an escalator without
+// PreserveEnv is passed on the command line instead.
+func (r *RealExecutor) environ(c Cmd, esc Escalator) []string {
+	var environ []string
+	if r.Env != nil {
+		environ = r.Env.Environ()
+	}
+	if len(c.Env) == 0 || (c.Sudo && esc.envOnCommandLine()) {
+		return environ
+	}
+	if environ == nil {
+		environ = os.Environ()
+	}
+	return append(environ, c.Env...)
+}
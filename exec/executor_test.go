@@ -1,14 +1,20 @@
 package exec
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/cwood/dotgraph/redact"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestRealExecutor_Run_Success(t *testing.T) {
-	executor := NewRealExecutor()
+	executor := &RealExecutor{LogDir: t.TempDir()}
 
 	result := executor.Run("echo", "hello")
 
@@ -18,7 +24,7 @@ func TestRealExecutor_Run_Success(t *testing.T) {
 }
 
 func TestRealExecutor_Run_Failure(t *testing.T) {
-	executor := NewRealExecutor()
+	executor := &RealExecutor{LogDir: t.TempDir()}
 
 	// Run a command that will fail
 	result := executor.Run("false")
@@ -30,7 +36,7 @@ func TestRealExecutor_Run_Failure(t *testing.T) {
 }
 
 func TestRealExecutor_Run_CommandNotFound(t *testing.T) {
-	executor := NewRealExecutor()
+	executor := &RealExecutor{LogDir: t.TempDir()}
 
 	result := executor.Run("nonexistent-command-12345")
 
@@ -38,6 +44,315 @@ func TestRealExecutor_Run_CommandNotFound(t *testing.T) {
 	assert.Error(t, result.Error)
 }
 
+func TestRealExecutor_Run_CapturesOutput(t *testing.T) {
+	executor := &RealExecutor{LogDir: t.TempDir()}
+
+	result := executor.Run("sh", "-c", "echo one; echo two; echo oops >&2; exit 3")
+
+	assert.False(t, result.Success)
+	assert.Equal(t, 3, result.ExitCode)
+	assert.Equal(t, "one\ntwo\n", result.Stdout)
+	assert.Equal(t, "oops\n", result.Stderr)
+	assert.Equal(t, []string{"one", "two"}, result.Lines())
+	assert.Equal(t, "sh -c echo one; echo two; echo oops >&2; exit 3", result.Command)
+	assert.Positive(t, result.Duration)
+
+	logContent, err := os.ReadFile(result.LogFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(logContent), "Exit Code: 3")
+	assert.Contains(t, string(logContent), "oops")
+}
+
+func TestRealExecutor_Run_TruncatesOutput(t *testing.T) {
+	executor := &RealExecutor{LogDir: t.TempDir()}
+	executor.MaxOutput = 10
+	executor.TailOutput = 4
+
+	result := executor.Run("printf", "0123456789abcdef")
+
+	assert.True(t, result.Success)
+	assert.Equal(t, 0, result.ExitCode)
+	assert.Equal(t, "[... truncated 12 bytes]\ncdef", result.Stdout)
+}
+
+func TestRealExecutor_Run_SpillsOutput(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	executor := &RealExecutor{LogDir: t.TempDir(), MaxOutput: 1 << 10, TailOutput: 16}
+
+	result := executor.Run("sh", "-c", "seq 1 100000; echo 'password=hunter22 failed' >&2; exit 1")
+
+	require.False(t, result.Success)
+	assert.Equal(t, "[... truncated 588879 bytes]\n98\n99999\n100000\n", result.Stdout)
+	assert.Equal(t, "password=hunter22 failed\n", result.Stderr)
+
+	content, err := os.ReadFile(result.LogFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "\n=== STDOUT ===\n1\n2\n3\n")
+	assert.Contains(t, string(content), "\n99999\n100000\n\n\n=== STDERR ===\npassword=[REDACTED] failed\n")
+	assert.NotContains(t, string(content), "hunter22")
+
+	// The spill file is removed
+	entries, err := os.ReadDir(tmp)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestRealExecutor_Run_BinaryOutput(t *testing.T) {
+	executor := &RealExecutor{LogDir: t.TempDir()}
+
+	result := executor.Run("sh", "-c", `printf 'ELF\000\001\002'; exit 1`)
+
+	require.False(t, result.Success)
+	assert.Equal(t, "ELF\x00\x01\x02", result.Stdout)
+	content, err := os.ReadFile(result.LogFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "=== STDOUT ===\n[binary output, 6 bytes]\n")
+}
+
+func TestRealExecutor_RunContext_OnLine(t *testing.T) {
+	executor := &RealExecutor{LogDir: t.TempDir()}
+
+	var lines []string
+	result := executor.RunContext(context.Background(), Cmd{
+		Name: "sh",
+		Args: []string{"-c", "echo one; echo two >&2; printf three"},
+		OnLine: func(stream Stream, line string) {
+			lines = append(lines, string(stream)+": "+line)
+		},
+	})
+
+	assert.True(t, result.Success)
+	assert.ElementsMatch(t, []string{"stdout: one", "stderr: two", "stdout: three"}, lines)
+	assert.Equal(t, "one\nthree", result.Stdout)
+}
+
+func TestWriteLines(t *testing.T) {
+	var buf strings.Builder
+
+	out, _ := newLineWriters(WriteLines(&buf, "[yay]"))
+	out.Write([]byte("resolving\r\ndownl"))
+	out.Write([]byte("oading\n"))
+	out.Write([]byte("done"))
+	out.Flush()
+
+	assert.Equal(t, "[yay] resolving\n[yay] downloading\n[yay] done\n", buf.String())
+}
+
+func TestRunResult_Trimmed(t *testing.T) {
+	result := RunResult{Stdout: "  /opt/homebrew\n"}
+
+	assert.Equal(t, "/opt/homebrew", result.Trimmed())
+	assert.Nil(t, RunResult{}.Lines())
+}
+
+func TestRealExecutor_RunContext_Success(t *testing.T) {
+	executor := &RealExecutor{LogDir: t.TempDir()}
+
+	result := executor.RunContext(context.Background(), Cmd{Name: "echo", Args: []string{"hello"}})
+
+	assert.True(t, result.Success)
+	assert.NoError(t, result.Error)
+}
+
+func TestRealExecutor_RunContext_Cancel(t *testing.T) {
+	executor := &RealExecutor{LogDir: t.TempDir()}
+	executor.GracePeriod = 100 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The background sleep keeps stdout open, so only a process group
+	// kill lets the command finish quickly
+	start := time.Now()
+	result := executor.RunContext(ctx, Cmd{Name: "sh", Args: []string{"-c", "trap '' TERM; sleep 30 & sleep 30"}})
+
+	assert.False(t, result.Success)
+	assert.ErrorIs(t, result.Error, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRealExecutor_RunContext_Spec(t *testing.T) {
+	executor := &RealExecutor{LogDir: t.TempDir()}
+	dir := t.TempDir()
+
+	result := executor.RunContext(context.Background(), Cmd{
+		Name:  "sh",
+		Args:  []string{"-c", `[ "$(pwd -P)" = "$EXPECTED" ] && [ "$(cat)" = "input" ]`},
+		Dir:   dir,
+		Env:   []string{"EXPECTED=" + evalSymlinks(t, dir)},
+		Stdin: strings.NewReader("input"),
+	})
+
+	assert.True(t, result.Success)
+}
+
+func TestRealExecutor_RunContext_Timeout(t *testing.T) {
+	executor := &RealExecutor{LogDir: t.TempDir()}
+
+	result := executor.RunContext(context.Background(), Cmd{Name: "sleep", Args: []string{"30"}, Timeout: 50 * time.Millisecond})
+
+	assert.False(t, result.Success)
+	assert.ErrorIs(t, result.Error, context.DeadlineExceeded)
+}
+
+func TestCmd_String(t *testing.T) {
+	cmd := Cmd{Name: "pacman", Args: []string{"-S", "git"}, Env: []string{"LANG=C"}, Sudo: true}
+
+	assert.Equal(t, "sudo --preserve-env=LANG -- pacman -S git", cmd.Format(SudoEscalator))
+	assert.Equal(t, "doas env LANG=C pacman -S git", cmd.Format(DoasEscalator))
+	assert.Equal(t, "pacman -S git", cmd.Format(NoEscalator))
+	assert.Equal(t, cmd.Format(DetectEscalator()), cmd.String())
+}
+
+func TestRealExecutor_RunContext_Escalator(t *testing.T) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	program := filepath.Join(dir, "fake-sudo")
+	require.NoError(t, os.WriteFile(program, []byte(`#!/bin/sh
+echo "$*" >> `+calls+`
+[ "$1" = -n ] && shift
+[ "$1" = -v ] && exit 0
+exec "$@"
+`), 0755))
+
+	esc := Escalator{Program: program, PrimeArgs: []string{"-v"}}
+	executor := &RealExecutor{LogDir: dir, Escalator: &esc}
+	defer executor.Close()
+
+	first := executor.RunContext(context.Background(), Cmd{Name: "sh", Args: []string{"-c", "echo $GREETING"}, Env: []string{"GREETING=hi"}, Sudo: true})
+	second := executor.RunContext(context.Background(), Cmd{Name: "true", Sudo: true})
+	plain := executor.RunContext(context.Background(), Cmd{Name: "true"})
+
+	require.True(t, first.Success, first.Error)
+	assert.Equal(t, "hi\n", first.Stdout)
+	assert.True(t, first.Elevated)
+	assert.Equal(t, program+" env GREETING=hi sh -c echo $GREETING", first.Command)
+	assert.True(t, second.Elevated)
+	assert.False(t, plain.Elevated)
+
+	data, err := os.ReadFile(calls)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 3)
+	assert.Contains(t, lines[0], "-v")
+	assert.Equal(t, "env GREETING=hi sh -c echo $GREETING", lines[1])
+	assert.Equal(t, "true", lines[2])
+}
+
+func TestRealExecutor_RunContext_PreserveEnv(t *testing.T) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	program := filepath.Join(dir, "fake-sudo")
+	require.NoError(t, os.WriteFile(program, []byte(`#!/bin/sh
+echo "$*" >> `+calls+`
+while case "$1" in -n|--preserve-env=*|--) ;; *) false ;; esac; do shift; done
+exec "$@"
+`), 0755))
+
+	esc := Escalator{Program: program, Args: []string{"--"}, PreserveEnv: "--preserve-env="}
+	executor := &RealExecutor{LogDir: dir, Escalator: &esc}
+
+	result := executor.RunContext(context.Background(), Cmd{Name: "sh", Args: []string{"-c", "echo $TOKEN"}, Env: []string{"TOKEN=hunter22"}, Sudo: true})
+
+	require.True(t, result.Success, result.Error)
+	assert.Equal(t, "hunter22\n", result.Stdout)
+	data, err := os.ReadFile(calls)
+	require.NoError(t, err)
+	assert.Equal(t, "--preserve-env=TOKEN -- sh -c echo $TOKEN\n", string(data))
+}
+
+func TestRealExecutor_RunContext_PrimeRetry(t *testing.T) {
+	dir := t.TempDir()
+	attempts := filepath.Join(dir, "attempts")
+	program := filepath.Join(dir, "fake-sudo")
+	require.NoError(t, os.WriteFile(program, []byte(`#!/bin/sh
+[ "$1" = -n ] && shift
+if [ "$1" = -v ]; then
+	echo x >> `+attempts+`
+	[ "$(wc -l < `+attempts+`)" -gt 1 ]
+	exit
+fi
+exec "$@"
+`), 0755))
+
+	esc := Escalator{Program: program, PrimeArgs: []string{"-v"}}
+	executor := &RealExecutor{LogDir: dir, Escalator: &esc}
+	defer executor.Close()
+
+	first := executor.RunContext(context.Background(), Cmd{Name: "true", Sudo: true, Timeout: time.Nanosecond})
+	second := executor.RunContext(context.Background(), Cmd{Name: "true", Sudo: true})
+	third := executor.RunContext(context.Background(), Cmd{Name: "true", Sudo: true})
+
+	assert.False(t, first.Success)
+	assert.NotErrorIs(t, first.Error, context.DeadlineExceeded)
+	require.True(t, second.Success, second.Error)
+	require.True(t, third.Success, third.Error)
+
+	data, err := os.ReadFile(attempts)
+	require.NoError(t, err)
+	assert.Equal(t, "x\nx\n", string(data))
+}
+
+func TestRealExecutor_RunContext_NoEscalator(t *testing.T) {
+	executor := &RealExecutor{LogDir: t.TempDir(), Escalator: &NoEscalator}
+
+	result := executor.RunContext(context.Background(), Cmd{Name: "sh", Args: []string{"-c", "echo $GREETING"}, Env: []string{"GREETING=hi"}, Sudo: true})
+
+	if os.Geteuid() == 0 {
+		require.True(t, result.Success, result.Error)
+		assert.Equal(t, "hi\n", result.Stdout)
+		assert.Equal(t, "sh -c echo $GREETING", result.Command)
+	} else {
+		assert.ErrorContains(t, result.Error, "not running as root")
+	}
+	assert.True(t, result.Elevated)
+}
+
+func TestRealExecutor_RunContext_RedactsSecrets(t *testing.T) {
+	redactor := redact.New()
+	redactor.AddSecret("hunter22")
+	executor := &RealExecutor{LogDir: t.TempDir(), Redactor: redactor}
+
+	var lines []string
+	result := executor.RunContext(context.Background(), Cmd{
+		Name:   "sh",
+		Args:   []string{"-c", "echo password hunter22; echo https://tok@example.com; exit 1", "https://tok@example.com"},
+		OnLine: func(stream Stream, line string) { lines = append(lines, line) },
+	})
+
+	require.False(t, result.Success)
+	assert.Equal(t, []string{"password [REDACTED]", "https://[REDACTED]@example.com"}, lines)
+	assert.NotContains(t, result.Command, "tok@")
+
+	content, err := os.ReadFile(result.LogFile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "hunter22")
+	assert.NotContains(t, string(content), "tok@")
+}
+
+func TestSetDefault(t *testing.T) {
+	mockExec := new(MockExecutor)
+	mockExec.ExpectRunSuccess("brew", []string{"update"})
+	SetDefault(mockExec)
+	defer SetDefault(nil)
+
+	result := RunQuiet("brew", "update")
+
+	assert.True(t, result.Success)
+	assert.Same(t, mockExec, Default())
+	mockExec.AssertExpectations(t)
+}
+
+func TestDefault_CreatesRealExecutor(t *testing.T) {
+	SetDefault(nil)
+
+	_, ok := Default().(*RealExecutor)
+
+	assert.True(t, ok)
+	assert.Same(t, Default(), Default())
+}
+
 func TestRealExecutor_LookPath_Exists(t *testing.T) {
 	executor := NewRealExecutor()
 
@@ -81,6 +396,41 @@ func TestMockExecutor_Run_Failure(t *testing.T) {
 	mock.AssertExpectations(t)
 }
 
+func TestMockExecutor_RunContext(t *testing.T) {
+	mock := new(MockExecutor)
+
+	cmd := Cmd{Name: "git", Args: []string{"status"}}
+	mock.ExpectRunContextSuccess(cmd)
+
+	result := mock.RunContext(context.Background(), cmd)
+
+	assert.True(t, result.Success)
+	mock.AssertExpectations(t)
+}
+
+func TestMockExecutor_ExpectCmd(t *testing.T) {
+	mock := new(MockExecutor)
+
+	mock.ExpectCmd(RunResult{Success: true},
+		MatchName("git"),
+		MatchDir("/repo"),
+		MatchEnv("GIT_TERMINAL_PROMPT=0"),
+		MatchStdin("data"),
+		MatchSudo(false),
+	)
+
+	result := mock.RunContext(context.Background(), Cmd{
+		Name:  "git",
+		Args:  []string{"apply"},
+		Dir:   "/repo",
+		Env:   []string{"HOME=/root", "GIT_TERMINAL_PROMPT=0"},
+		Stdin: strings.NewReader("data"),
+	})
+
+	assert.True(t, result.Success)
+	mock.AssertExpectations(t)
+}
+
 func TestMockExecutor_LookPath_Exists(t *testing.T) {
 	mock := new(MockExecutor)
 
@@ -127,3 +477,52 @@ func TestCommandNotFoundError(t *testing.T) {
 
 	assert.Equal(t, "command not found: brew", err.Error())
 }
+
+func evalSymlinks(t *testing.T, path string) string {
+	t.Helper()
+	resolved, err := filepath.EvalSymlinks(path)
+	require.NoError(t, err)
+	return resolved
+}
+
+func TestRealExecutor_RunContext_Policy(t *testing.T) {
+	dir := t.TempDir()
+	policy, err := ParsePolicy([]byte("allow:\n  sh: []\n"))
+	require.NoError(t, err)
+	executor := &RealExecutor{LogDir: dir, Policy: policy}
+
+	result := executor.Run("touch", filepath.Join(dir, "created"))
+
+	var violation *PolicyViolationError
+	require.ErrorAs(t, result.Error, &violation)
+	assert.Equal(t, "touch", violation.Cmd.Name)
+	assert.Equal(t, -1, result.ExitCode)
+	assert.NoFileExists(t, filepath.Join(dir, "created"))
+	assert.True(t, executor.Run("sh", "-c", "true").Success)
+}
+
+func TestRealExecutor_RunContext_Usage(t *testing.T) {
+	executor := &RealExecutor{LogDir: t.TempDir()}
+	ctx, stats := WithStats(context.Background())
+
+	busy := executor.RunContext(ctx, Cmd{Name: "sh", Args: []string{"-c", "i=0; while [ $i -lt 100000 ]; do i=$((i+1)); done"}})
+	failed := executor.RunContext(ctx, Cmd{Name: "sh", Args: []string{"-c", "exit 3"}})
+	executor.RunContext(ctx, Cmd{Name: "nonexistent-command-12345"})
+
+	require.True(t, busy.Success, busy.Error)
+	assert.Positive(t, busy.Usage.CPUTime())
+	assert.Positive(t, busy.Usage.MaxRSS)
+	assert.Equal(t, 3, failed.ExitCode)
+	assert.Equal(t, 2, stats.Commands())
+	assert.Equal(t, busy.Usage.CPUTime()+failed.Usage.CPUTime(), stats.Usage().CPUTime())
+	assert.Equal(t, max(busy.Usage.MaxRSS, failed.Usage.MaxRSS), stats.Usage().MaxRSS)
+}
+
+func TestUsage_Add(t *testing.T) {
+	usage := Usage{UserTime: time.Second, SystemTime: time.Second, MaxRSS: 4 << 20}
+	usage.Add(Usage{UserTime: 2 * time.Second, MaxRSS: 1 << 20})
+	usage.Add(Usage{SystemTime: time.Second, MaxRSS: 8 << 20})
+
+	assert.Equal(t, Usage{UserTime: 3 * time.Second, SystemTime: 2 * time.Second, MaxRSS: 8 << 20}, usage)
+	assert.Equal(t, 5*time.Second, usage.CPUTime())
+}
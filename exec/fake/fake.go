@@ -0,0 +1,337 @@
+// Package fake provides a scriptable CommandExecutor for tests.
+//
+// Unlike exec.MockExecutor, commands are matched by patterns rather than
+// exact argument slices, PATH lookups answer from a virtual PATH, and
+// assertions are made afterwards against a log of the calls:
+//
+//	f := fake.New()
+//	f.AddToPath("pacman")
+//	f.On("pacman", "-S *").Stdout("installed\n")
+//	f.On("git", "clone *").Fail(128, "fatal: repository not found")
+//
+//	// ... run code under test with f as its executor ...
+//
+//	f.AssertRanInOrder(t, fake.Glob("pacman", "-S *"), fake.Glob("git", "clone *"))
+package fake
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/cwood/dotgraph/exec"
+	"github.com/stretchr/testify/mock"
+)
+
+// Matcher selects commands by name and arguments
+type Matcher struct {
+	name *regexp.Regexp
+	args *regexp.Regexp
+	desc string
+}
+
+// Command matches commands named name with any arguments
+func Command(name string) Matcher {
+	return Glob(name, "*")
+}
+
+// Glob matches commands whose name and space-joined arguments match the
+// glob patterns. A * matches any run of characters, including spaces, and
+// ? matches a single character.
+func Glob(name, args string) Matcher {
+	return Matcher{name: exec.GlobRegexp(name), args: exec.GlobRegexp(args), desc: name + " " + args}
+}
+
+// Regexp matches commands named name whose space-joined arguments match
+// the regular expression. It panics if the expression is invalid.
+func Regexp(name, args string) Matcher {
+	return Matcher{name: exec.GlobRegexp(name), args: regexp.MustCompile(args), desc: name + " /" + args + "/"}
+}
+
+// Match reports whether cmd matches
+func (m Matcher) Match(cmd exec.Cmd) bool {
+	return m.name.MatchString(cmd.Name) && m.args.MatchString(strings.Join(cmd.Args, " "))
+}
+
+func (m Matcher) String() string {
+	return m.desc
+}
+
+// Handler produces the result of a faked command
+type Handler func(ctx context.Context, cmd exec.Cmd) exec.RunResult
+
+// Rule is a registered handler for the commands a Matcher selects
+type Rule struct {
+	matcher Matcher
+	handler Handler
+	limit   int
+	used    int
+}
+
+// Do sets the function that produces the command's result
+func (r *Rule) Do(handler Handler) *Rule {
+	r.handler = handler
+	return r
+}
+
+// Return makes the command return result
+func (r *Rule) Return(result exec.RunResult) *Rule {
+	return r.Do(func(context.Context, exec.Cmd) exec.RunResult { return result })
+}
+
+// Stdout makes the command succeed and print out
+func (r *Rule) Stdout(out string) *Rule {
+	return r.Return(exec.RunResult{Success: true, Stdout: out})
+}
+
+// Fail makes the command exit with exitCode and print stderr
+func (r *Rule) Fail(exitCode int, stderr string) *Rule {
+	return r.Return(exec.RunResult{
+		Error:    fmt.Errorf("exit status %d", exitCode),
+		Stderr:   stderr,
+		ExitCode: exitCode,
+	})
+}
+
+// Times limits the rule to the next n matching commands
+func (r *Rule) Times(n int) *Rule {
+	r.limit = n
+	return r
+}
+
+// Once limits the rule to the next matching command
+func (r *Rule) Once() *Rule {
+	return r.Times(1)
+}
+
+// Call is a command run through a FakeExecutor
+type Call struct {
+	Cmd exec.Cmd
+
+	// Stdin is what the command was given on standard input
+	Stdin string
+
+	Result exec.RunResult
+}
+
+// String returns the command line of the call
+func (c Call) String() string {
+	return c.Cmd.String()
+}
+
+// UnhandledCommandError is returned for commands no rule matches
+type UnhandledCommandError struct {
+	Cmd exec.Cmd
+}
+
+func (e *UnhandledCommandError) Error() string {
+	return "no fake registered for command: " + e.Cmd.String()
+}
+
+// FakeExecutor implements exec.CommandExecutor with registered rules.
+//
+// The most recently registered matching rule handles a command, so tests
+// can override defaults set up by a helper. Commands without a rule fail
+// with exit code 127 and *UnhandledCommandError.
+type FakeExecutor struct {
+	mu    sync.Mutex
+	rules []*Rule
+	path  map[string]string
+	calls []Call
+}
+
+// New creates a FakeExecutor with an empty PATH and no rules
+func New() *FakeExecutor {
+	return &FakeExecutor{path: make(map[string]string)}
+}
+
+// Handle registers a rule for commands selected by matcher. Until Do or
+// one of its shortcuts is called, matching commands succeed without output.
+func (f *FakeExecutor) Handle(matcher Matcher) *Rule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rule := &Rule{matcher: matcher}
+	rule.Stdout("")
+	f.rules = append(f.rules, rule)
+	return rule
+}
+
+// On registers a rule for commands named name whose arguments match the
+// glob pattern args
+func (f *FakeExecutor) On(name, args string) *Rule {
+	return f.Handle(Glob(name, args))
+}
+
+// AddToPath puts commands on the virtual PATH under /usr/bin
+func (f *FakeExecutor) AddToPath(names ...string) {
+	for _, name := range names {
+		f.AddToPathAt(name, path.Join("/usr/bin", name))
+	}
+}
+
+// AddToPathAt puts a command on the virtual PATH at the given location
+func (f *FakeExecutor) AddToPathAt(name, location string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.path[name] = location
+}
+
+// RemoveFromPath takes commands off the virtual PATH
+func (f *FakeExecutor) RemoveFromPath(names ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, name := range names {
+		delete(f.path, name)
+	}
+}
+
+// LookPath answers from the virtual PATH
+func (f *FakeExecutor) LookPath(cmd string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if location, ok := f.path[cmd]; ok {
+		return location, nil
+	}
+	return "", &exec.CommandNotFoundError{Cmd: cmd}
+}
+
+// Run runs a command through the registered rules
+func (f *FakeExecutor) Run(name string, args ...string) exec.RunResult {
+	return f.RunContext(context.Background(), exec.Cmd{Name: name, Args: args})
+}
+
+// RunContext runs a command through the most recently registered matching
+// rule and records the call. Output is passed to cmd.OnLine line by line.
+func (f *FakeExecutor) RunContext(ctx context.Context, cmd exec.Cmd) exec.RunResult {
+	var stdin string
+	if cmd.Stdin != nil {
+		data, err := io.ReadAll(cmd.Stdin)
+		if err != nil {
+			return exec.RunResult{Error: err, ExitCode: -1}
+		}
+		stdin = string(data)
+		cmd.Stdin = bytes.NewReader(data)
+	}
+
+	result := exec.RunResult{Error: &UnhandledCommandError{Cmd: cmd}, ExitCode: 127}
+	if rule := f.match(cmd); rule != nil {
+		result = rule.handler(ctx, cmd)
+	}
+	if result.Command == "" {
+		result.Command = cmd.String()
+	}
+	result.Elevated = cmd.Sudo
+
+	if cmd.OnLine != nil {
+		sendLines(cmd.OnLine, exec.Stdout, result.Stdout)
+		sendLines(cmd.OnLine, exec.Stderr, result.Stderr)
+	}
+
+	f.mu.Lock()
+	f.calls = append(f.calls, Call{Cmd: cmd, Stdin: stdin, Result: result})
+	f.mu.Unlock()
+	return result
+}
+
+// match returns the rule for cmd and counts its use
+func (f *FakeExecutor) match(cmd exec.Cmd) *Rule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.rules) - 1; i >= 0; i-- {
+		rule := f.rules[i]
+		if rule.limit > 0 && rule.used >= rule.limit {
+			continue
+		}
+		if rule.matcher.Match(cmd) {
+			rule.used++
+			return rule
+		}
+	}
+	return nil
+}
+
+func sendLines(handler exec.LineHandler, stream exec.Stream, output string) {
+	output = strings.TrimSuffix(output, "\n")
+	if output == "" {
+		return
+	}
+	for _, line := range strings.Split(output, "\n") {
+		handler(stream, line)
+	}
+}
+
+// Calls returns every command run so far, in order
+func (f *FakeExecutor) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// CallsMatching returns the commands run so far that matcher selects
+func (f *FakeExecutor) CallsMatching(matcher Matcher) []Call {
+	var calls []Call
+	for _, call := range f.Calls() {
+		if matcher.Match(call.Cmd) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Ran reports whether a command selected by matcher was run
+func (f *FakeExecutor) Ran(matcher Matcher) bool {
+	return len(f.CallsMatching(matcher)) > 0
+}
+
+// AssertRan fails the test unless a command selected by matcher was run
+func (f *FakeExecutor) AssertRan(t mock.TestingT, matcher Matcher) bool {
+	if f.Ran(matcher) {
+		return true
+	}
+	t.Errorf("expected a command matching %q to run, got:\n%s", matcher, f.callList())
+	return false
+}
+
+// AssertNotRan fails the test if a command selected by matcher was run
+func (f *FakeExecutor) AssertNotRan(t mock.TestingT, matcher Matcher) bool {
+	calls := f.CallsMatching(matcher)
+	if len(calls) == 0 {
+		return true
+	}
+	t.Errorf("expected no command matching %q to run, got %s", matcher, calls[0])
+	return false
+}
+
+// AssertRanInOrder fails the test unless commands selected by the matchers
+// were run in that order. Other commands may run in between.
+func (f *FakeExecutor) AssertRanInOrder(t mock.TestingT, matchers ...Matcher) bool {
+	next := 0
+	for _, call := range f.Calls() {
+		if next < len(matchers) && matchers[next].Match(call.Cmd) {
+			next++
+		}
+	}
+	if next == len(matchers) {
+		return true
+	}
+	t.Errorf("expected commands in order, no command matching %q after the previous ones, got:\n%s", matchers[next], f.callList())
+	return false
+}
+
+// callList formats the call log for failure messages
+func (f *FakeExecutor) callList() string {
+	calls := f.Calls()
+	if len(calls) == 0 {
+		return "\t(no commands)"
+	}
+	lines := make([]string, len(calls))
+	for i, call := range calls {
+		lines[i] = "\t" + call.String()
+	}
+	return strings.Join(lines, "\n")
+}
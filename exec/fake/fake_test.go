@@ -0,0 +1,120 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cwood/dotgraph/exec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeExecutor_ImplementsCommandExecutor(t *testing.T) {
+	var _ exec.CommandExecutor = (*FakeExecutor)(nil)
+}
+
+func TestFakeExecutor_On_Glob(t *testing.T) {
+	f := New()
+	f.On("git", "clone * ~/dotfiles").Stdout("Cloning\n")
+
+	result := f.Run("git", "clone", "--depth", "1", "https://example.com/dots.git", "~/dotfiles")
+	other := f.Run("git", "pull")
+
+	assert.True(t, result.Success)
+	assert.Equal(t, "Cloning\n", result.Stdout)
+	assert.Equal(t, "git clone --depth 1 https://example.com/dots.git ~/dotfiles", result.Command)
+
+	var unhandled *UnhandledCommandError
+	require.True(t, errors.As(other.Error, &unhandled))
+	assert.Equal(t, 127, other.ExitCode)
+}
+
+func TestFakeExecutor_On_GlobMultiLine(t *testing.T) {
+	f := New()
+	f.On("sh", "-c *rm -rf*").Fail(1, "denied")
+
+	result := f.Run("sh", "-c", "echo hi\nrm -rf ~/x")
+
+	assert.False(t, result.Success)
+	assert.Equal(t, "denied", result.Stderr)
+}
+
+func TestFakeExecutor_Handle_Regexp(t *testing.T) {
+	f := New()
+	f.Handle(Regexp("pacman", `^-S( [a-z]+)+$`)).Fail(1, "error: target not found")
+
+	result := f.Run("pacman", "-S", "git", "tmux")
+
+	assert.False(t, result.Success)
+	assert.Equal(t, 1, result.ExitCode)
+	assert.Equal(t, "error: target not found", result.Stderr)
+	assert.False(t, f.Run("pacman", "-Syu").Success)
+}
+
+func TestFakeExecutor_LatestRuleWins(t *testing.T) {
+	f := New()
+	f.Handle(Command("brew")).Stdout("default\n")
+	f.On("brew", "--prefix").Stdout("/opt/homebrew\n").Once()
+
+	assert.Equal(t, "/opt/homebrew", f.Run("brew", "--prefix").Trimmed())
+	assert.Equal(t, "default", f.Run("brew", "--prefix").Trimmed())
+}
+
+func TestFakeExecutor_Do(t *testing.T) {
+	f := New()
+	f.On("pacman", "-S *").Do(func(ctx context.Context, cmd exec.Cmd) exec.RunResult {
+		f.AddToPath(cmd.Args[1:]...)
+		return exec.RunResult{Success: true, Stdout: "installed\n"}
+	})
+
+	_, err := f.LookPath("git")
+	assert.Error(t, err)
+
+	var lines []string
+	f.RunContext(context.Background(), exec.Cmd{
+		Name:   "pacman",
+		Args:   []string{"-S", "git"},
+		Stdin:  strings.NewReader("y\n"),
+		OnLine: func(stream exec.Stream, line string) { lines = append(lines, line) },
+	})
+
+	path, err := f.LookPath("git")
+	require.NoError(t, err)
+	assert.Equal(t, "/usr/bin/git", path)
+	assert.Equal(t, []string{"installed"}, lines)
+	assert.Equal(t, "y\n", f.Calls()[0].Stdin)
+}
+
+func TestFakeExecutor_AssertRanInOrder(t *testing.T) {
+	f := New()
+	f.Handle(Command("*"))
+	f.Run("pacman", "-S", "git")
+	f.Run("echo", "hi")
+	f.Run("git", "clone", "url", "dest")
+
+	assert.True(t, f.AssertRanInOrder(t, Glob("pacman", "-S *"), Glob("git", "clone *")))
+	assert.True(t, f.AssertRan(t, Command("echo")))
+	assert.True(t, f.AssertNotRan(t, Command("yay")))
+
+	rt := &recordingT{}
+	assert.False(t, f.AssertRanInOrder(rt, Glob("git", "clone *"), Glob("pacman", "-S *")))
+	require.Len(t, rt.errors, 1)
+	assert.Contains(t, rt.errors[0], `"pacman -S *"`)
+	assert.Contains(t, rt.errors[0], "git clone url dest")
+}
+
+// recordingT collects failures instead of failing the test
+type recordingT struct {
+	errors []string
+}
+
+func (r *recordingT) Logf(format string, args ...any) {}
+
+func (r *recordingT) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingT) FailNow() {}
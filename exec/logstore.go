@@ -0,0 +1,294 @@
+package exec
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogIndexFile is the name of the index kept in a LogStore's directory
+const LogIndexFile = "index.jsonl"
+
+// LogStore keeps failure logs in a directory, with an index of them so
+// recent failures can be listed. The directory is created on first use.
+type LogStore struct {
+	// Dir is the directory holding the logs and the index
+	Dir string
+
+	// MaxAge is how long logs are kept. Zero keeps them forever.
+	MaxAge time.Duration
+
+	// MaxBytes caps the total size of the logs; the oldest are removed
+	// first. Zero means no limit.
+	MaxBytes int64
+
+	mu sync.Mutex
+}
+
+// LogEntry describes a failure log in the index
+type LogEntry struct {
+	// Path is the log file
+	Path string `json:"path"`
+
+	Time  time.Time `json:"time"`
+	Stage string    `json:"stage,omitempty"`
+
+	// Name is the program that failed, used in the file name
+	Name string `json:"name"`
+
+	// Command is the full command line
+	Command  string `json:"command"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+}
+
+// NewLogStore creates a LogStore in dir without retention limits
+func NewLogStore(dir string) *LogStore {
+	return &LogStore{Dir: dir}
+}
+
+// StateDir returns $XDG_STATE_HOME/dotgraph, where dotgraph keeps logs and
+// run history, falling back to ~/.local/state when XDG_STATE_HOME is not set
+func StateDir() string {
+	stateDir := os.Getenv("XDG_STATE_HOME")
+	if stateDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			homeDir = os.TempDir()
+		}
+		stateDir = filepath.Join(homeDir, ".local", "state")
+	}
+	return filepath.Join(stateDir, "dotgraph")
+}
+
+// DefaultLogDir returns the logs directory in StateDir
+func DefaultLogDir() string {
+	return filepath.Join(StateDir(), "logs")
+}
+
+// DefaultLogStore returns the LogStore in DefaultLogDir that keeps logs for
+// 30 days and at most 100 MiB of them. Every call returns the same store, so
+// executors share its lock on the index.
+var DefaultLogStore = sync.OnceValue(func() *LogStore {
+	return &LogStore{Dir: DefaultLogDir(), MaxAge: 30 * 24 * time.Hour, MaxBytes: 100 << 20}
+})
+
+// Save writes a failure log, adds it to the index and applies the retention
+// limits. The file is named after the time, the stage and the command, with
+// a counter if that name is taken. It returns the path of the log.
+func (s *LogStore) Save(entry LogEntry, content []byte) (string, error) {
+	return s.Write(entry, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
+
+// Write is like Save, but streams the log's content from write instead of
+// taking it in memory
+func (s *LogStore) Write(entry LogEntry, write func(w io.Writer) error) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return "", err
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	f, err := s.create(entry)
+	if err != nil {
+		return "", err
+	}
+	buffered := bufio.NewWriter(f)
+	if err := write(buffered); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := buffered.Flush(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	entry.Path = f.Name()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	index, err := os.OpenFile(filepath.Join(s.Dir, LogIndexFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := index.Write(append(line, '\n')); err != nil {
+		index.Close()
+		return "", err
+	}
+	if err := index.Close(); err != nil {
+		return "", err
+	}
+
+	if s.MaxAge > 0 || s.MaxBytes > 0 {
+		if err := s.prune(); err != nil {
+			return entry.Path, fmt.Errorf("prune logs: %w", err)
+		}
+	}
+	return entry.Path, nil
+}
+
+// create opens a new log file with a unique name for entry
+func (s *LogStore) create(entry LogEntry) (*os.File, error) {
+	parts := []string{entry.Time.Format("20060102-150405")}
+	if entry.Stage != "" {
+		parts = append(parts, sanitizeLogName(entry.Stage))
+	}
+	if entry.Name != "" {
+		parts = append(parts, sanitizeLogName(filepath.Base(entry.Name)))
+	}
+	base := strings.Join(parts, "-")
+
+	for n := 1; ; n++ {
+		name := base + ".log"
+		if n > 1 {
+			name = fmt.Sprintf("%s-%d.log", base, n)
+		}
+		f, err := os.OpenFile(filepath.Join(s.Dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if !errors.Is(err, os.ErrExist) {
+			return f, err
+		}
+	}
+}
+
+// sanitizeLogName replaces characters that do not belong in file names
+func sanitizeLogName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Recent returns up to n indexed logs that still exist, newest first.
+// A non-positive n returns all of them.
+func (s *LogStore) Recent(n int) ([]LogEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	recent := make([]LogEntry, 0)
+	for i := len(entries) - 1; i >= 0 && (n <= 0 || len(recent) < n); i-- {
+		if _, err := os.Stat(entries[i].Path); err == nil {
+			recent = append(recent, entries[i])
+		}
+	}
+	return recent, nil
+}
+
+// Prune removes logs beyond the retention limits and drops missing logs
+// from the index
+func (s *LogStore) Prune() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.prune()
+}
+
+func (s *LogStore) prune() error {
+	entries, err := s.readIndex()
+	if err != nil {
+		return err
+	}
+
+	// Newest first, so the size limit keeps the most recent logs
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+
+	var total int64
+	kept := make([]LogEntry, 0, len(entries))
+	for _, entry := range entries {
+		info, err := os.Stat(entry.Path)
+		if err != nil {
+			continue
+		}
+		expired := s.MaxAge > 0 && time.Since(entry.Time) > s.MaxAge
+		tooBig := s.MaxBytes > 0 && total+info.Size() > s.MaxBytes && len(kept) > 0
+		if expired || tooBig {
+			if err := os.Remove(entry.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		total += info.Size()
+		kept = append(kept, entry)
+	}
+	if len(kept) == len(entries) {
+		return nil
+	}
+
+	var buf strings.Builder
+	for i := len(kept) - 1; i >= 0; i-- {
+		line, err := json.Marshal(kept[i])
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	indexPath := filepath.Join(s.Dir, LogIndexFile)
+	tmp := indexPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(buf.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, indexPath)
+}
+
+// readIndex returns the index entries, oldest first. A missing index is
+// not an error.
+func (s *LogStore) readIndex() ([]LogEntry, error) {
+	f, err := os.Open(filepath.Join(s.Dir, LogIndexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []LogEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry LogEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+type stageKey struct{}
+
+// WithStage returns a context that names the pipeline stage running
+// commands, so their failure logs can be attributed to it
+func WithStage(ctx context.Context, stage string) context.Context {
+	return context.WithValue(ctx, stageKey{}, stage)
+}
+
+// StageFromContext returns the stage name set with WithStage, if any
+func StageFromContext(ctx context.Context) string {
+	stage, _ := ctx.Value(stageKey{}).(string)
+	return stage
+}
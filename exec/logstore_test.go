@@ -0,0 +1,107 @@
+package exec
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogStore_Save_UniqueNames(t *testing.T) {
+	store := NewLogStore(filepath.Join(t.TempDir(), "logs"))
+	now := time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)
+
+	first, err := store.Save(LogEntry{Time: now, Stage: "install git", Name: "/usr/bin/pacman"}, []byte("one"))
+	require.NoError(t, err)
+	second, err := store.Save(LogEntry{Time: now, Stage: "install git", Name: "/usr/bin/pacman"}, []byte("two"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "20261018-093000-install_git-pacman.log", filepath.Base(first))
+	assert.Equal(t, "20261018-093000-install_git-pacman-2.log", filepath.Base(second))
+}
+
+func TestLogStore_Recent(t *testing.T) {
+	store := NewLogStore(t.TempDir())
+	for _, name := range []string{"a", "b", "c"} {
+		_, err := store.Save(LogEntry{Name: name, Command: name + " --flag", ExitCode: 1}, []byte(name))
+		require.NoError(t, err)
+	}
+	entries, err := store.Recent(0)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(entries[1].Path))
+
+	recent, err := store.Recent(5)
+
+	require.NoError(t, err)
+	require.Len(t, recent, 2)
+	assert.Equal(t, "c --flag", recent[0].Command)
+	assert.Equal(t, "a --flag", recent[1].Command)
+	assert.Equal(t, 1, recent[0].ExitCode)
+}
+
+func TestLogStore_Retention(t *testing.T) {
+	store := &LogStore{Dir: t.TempDir(), MaxAge: 24 * time.Hour, MaxBytes: 10}
+
+	_, err := store.Save(LogEntry{Time: time.Now().Add(-48 * time.Hour), Name: "old"}, []byte("old"))
+	require.NoError(t, err)
+	_, err = store.Save(LogEntry{Time: time.Now().Add(-time.Minute), Name: "big"}, []byte("0123456789"))
+	require.NoError(t, err)
+	_, err = store.Save(LogEntry{Name: "new"}, []byte("new"))
+	require.NoError(t, err)
+
+	recent, err := store.Recent(0)
+	require.NoError(t, err)
+	require.Len(t, recent, 1)
+	assert.Equal(t, "new", recent[0].Name)
+
+	files, err := filepath.Glob(filepath.Join(store.Dir, "*.log"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	index, err := os.ReadFile(filepath.Join(store.Dir, LogIndexFile))
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(index), "\n"))
+}
+
+func TestRealExecutor_RunContext_LogsStage(t *testing.T) {
+	store := NewLogStore(t.TempDir())
+	executor := &RealExecutor{Logs: store}
+
+	result := executor.RunContext(WithStage(context.Background(), "dotfiles"), Cmd{Name: "false"})
+
+	require.False(t, result.Success)
+	assert.Contains(t, filepath.Base(result.LogFile), "-dotfiles-false.log")
+	content, err := os.ReadFile(result.LogFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "Stage: dotfiles\n")
+
+	recent, err := store.Recent(1)
+	require.NoError(t, err)
+	require.Len(t, recent, 1)
+	assert.Equal(t, "dotfiles", recent[0].Stage)
+	assert.Equal(t, result.LogFile, recent[0].Path)
+}
+
+func TestRealExecutor_RunContext_PruneError(t *testing.T) {
+	store := &LogStore{Dir: t.TempDir(), MaxBytes: 1}
+	_, err := store.Save(LogEntry{Name: "old"}, []byte("old output"))
+	require.NoError(t, err)
+	// A directory in the way of the rewritten index makes pruning fail
+	require.NoError(t, os.Mkdir(filepath.Join(store.Dir, LogIndexFile+".tmp"), 0755))
+	executor := &RealExecutor{Logs: store}
+
+	result := executor.RunContext(context.Background(), Cmd{Name: "false"})
+
+	require.False(t, result.Success)
+	require.NotEmpty(t, result.LogFile)
+	assert.FileExists(t, result.LogFile)
+}
+
+func TestDefaultLogStore(t *testing.T) {
+	assert.Same(t, DefaultLogStore(), DefaultLogStore())
+}
@@ -0,0 +1,172 @@
+package exec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/cwood/dotgraph/redact"
+)
+
+// ManifestEntry is a distinct command recorded in a Manifest
+type ManifestEntry struct {
+	// Command is the command line, with secrets redacted
+	Command string `json:"command"`
+
+	// Name is the program
+	Name string `json:"name"`
+
+	// Dir is the working directory, if set
+	Dir string `json:"dir,omitempty"`
+
+	// Elevated reports whether the command runs with Sudo
+	Elevated bool `json:"elevated,omitempty"`
+
+	// Stages are the stages that would run the command
+	Stages []string `json:"stages,omitempty"`
+
+	// Count is how many times the command would run
+	Count int `json:"count"`
+}
+
+// Manifest collects the distinct commands a run would invoke, so a graph
+// can be reviewed before it is run for real. Commands are deduplicated by
+// command line, directory and elevation, in the order first seen. It is
+// safe for concurrent use.
+type Manifest struct {
+	// Escalator names the program that elevates commands in WriteText.
+	// Preview sets it from the executor it wraps if it is nil; otherwise
+	// DetectEscalator's choice is shown.
+	Escalator *Escalator
+
+	mu      sync.Mutex
+	entries []ManifestEntry
+	index   map[manifestKey]int
+}
+
+type manifestKey struct {
+	command  string
+	dir      string
+	elevated bool
+}
+
+// NewManifest creates an empty Manifest
+func NewManifest() *Manifest {
+	return &Manifest{index: make(map[manifestKey]int)}
+}
+
+// Add records cmd, attributed to the stage named in ctx. Add on a nil
+// Manifest does nothing.
+func (m *Manifest) Add(ctx context.Context, cmd Cmd) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.index == nil {
+		m.index = make(map[manifestKey]int)
+	}
+
+	// Elevation is kept apart from the command line, which reads better
+	// than the escalator's wrapper
+	unelevated := cmd
+	unelevated.Sudo = false
+	key := manifestKey{command: redact.String(unelevated.String()), dir: cmd.Dir, elevated: cmd.Sudo}
+	i, ok := m.index[key]
+	if !ok {
+		i = len(m.entries)
+		m.index[key] = i
+		m.entries = append(m.entries, ManifestEntry{Command: key.command, Name: cmd.Name, Dir: cmd.Dir, Elevated: cmd.Sudo})
+	}
+	entry := &m.entries[i]
+	entry.Count++
+	if stage := StageFromContext(ctx); stage != "" && !slices.Contains(entry.Stages, stage) {
+		entry.Stages = append(entry.Stages, stage)
+	}
+}
+
+// Entries returns the recorded commands in the order first seen
+func (m *Manifest) Entries() []ManifestEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := make([]ManifestEntry, len(m.entries))
+	for i, entry := range m.entries {
+		entry.Stages = slices.Clone(entry.Stages)
+		entries[i] = entry
+	}
+	return entries
+}
+
+// Programs returns the distinct programs recorded, sorted
+func (m *Manifest) Programs() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for _, entry := range m.entries {
+		if !slices.Contains(names, entry.Name) {
+			names = append(names, entry.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WriteText writes one line per command, marking elevated commands and
+// listing the stages that run them
+func (m *Manifest) WriteText(w io.Writer) error {
+	m.mu.Lock()
+	esc := defaultEscalator()
+	if m.Escalator != nil {
+		esc = *m.Escalator
+	}
+	m.mu.Unlock()
+	label := "[" + esc.Program + "] "
+	if esc.Program == "" {
+		label = "[root] "
+	}
+
+	for _, entry := range m.Entries() {
+		line := entry.Command
+		if entry.Dir != "" {
+			line += " (in " + entry.Dir + ")"
+		}
+		if entry.Elevated {
+			line = label + line
+		}
+		if len(entry.Stages) > 0 {
+			line += fmt.Sprintf("  # %v", entry.Stages)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the entries as an indented JSON array
+func (m *Manifest) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(m.Entries())
+}
+
+// Preview records every command in m before passing it on. Placed in front
+// of DryRun, it collects what a run would invoke without running anything.
+func Preview(m *Manifest) Middleware {
+	return func(next CommandExecutor) CommandExecutor {
+		m.mu.Lock()
+		if m.Escalator == nil {
+			esc := EscalatorOf(next)
+			m.Escalator = &esc
+		}
+		m.mu.Unlock()
+		return &interceptor{next: next, run: func(ctx context.Context, cmd Cmd) RunResult {
+			m.Add(ctx, cmd)
+			return next.RunContext(ctx, cmd)
+		}}
+	}
+}
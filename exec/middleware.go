@@ -0,0 +1,216 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"github.com/cwood/dotgraph/redact"
+)
+
+// Middleware wraps a CommandExecutor to add behaviour around every command
+type Middleware func(next CommandExecutor) CommandExecutor
+
+// Chain wraps base in middlewares. The first middleware is the outermost,
+// so it sees each command first:
+//
+//	exec.Chain(exec.NewRealExecutor(), exec.Audit(log), exec.Enforce(policy), exec.DryRun(log))
+//
+// audits every command, including rejected ones, and only commands that
+// pass the policy reach the dry-run layer.
+func Chain(base CommandExecutor, middlewares ...Middleware) CommandExecutor {
+	executor := base
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		executor = middlewares[i](executor)
+	}
+	return executor
+}
+
+// interceptor is a CommandExecutor that passes commands to a function and
+// PATH lookups to the next executor
+type interceptor struct {
+	next CommandExecutor
+	run  func(ctx context.Context, cmd Cmd) RunResult
+}
+
+func (i *interceptor) Run(name string, args ...string) RunResult {
+	return i.RunContext(context.Background(), Cmd{Name: name, Args: args})
+}
+
+func (i *interceptor) RunContext(ctx context.Context, cmd Cmd) RunResult {
+	return i.run(ctx, cmd)
+}
+
+func (i *interceptor) LookPath(cmd string) (string, error) {
+	return i.next.LookPath(cmd)
+}
+
+func (i *interceptor) Environment() *Environment {
+	return EnvironmentOf(i.next)
+}
+
+func (i *interceptor) escalator() Escalator {
+	return EscalatorOf(i.next)
+}
+
+func (i *interceptor) redactor() *redact.Redactor {
+	return redactorOf(i.next)
+}
+
+// redactorOf returns the Redactor executor masks secrets with, also through
+// middleware, or redact.Default
+func redactorOf(executor CommandExecutor) *redact.Redactor {
+	if r, ok := executor.(interface{ redactor() *redact.Redactor }); ok {
+		return r.redactor()
+	}
+	return redact.Default
+}
+
+// commandLine returns cmd as next would run it, with secrets masked
+func commandLine(next CommandExecutor, cmd Cmd) string {
+	return redactorOf(next).String(cmd.Format(EscalatorOf(next)))
+}
+
+// Close closes the next executor if it can be, so a chain is closed like
+// its base, e.g. to stop a RealExecutor's sudo keep-alive
+func (i *interceptor) Close() error {
+	if closer, ok := i.next.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Audit logs every command with its outcome once it has finished
+func Audit(l *slog.Logger) Middleware {
+	return func(next CommandExecutor) CommandExecutor {
+		return &interceptor{next: next, run: func(ctx context.Context, cmd Cmd) RunResult {
+			result := next.RunContext(ctx, cmd)
+			attrs := []any{
+				"command", commandLine(next, cmd),
+				"success", result.Success,
+				"exit_code", result.ExitCode,
+				"duration", result.Duration,
+			}
+			if cmd.Dir != "" {
+				attrs = append(attrs, "dir", cmd.Dir)
+			}
+			if cmd.Sudo {
+				attrs = append(attrs, "elevated", true)
+			}
+			if result.Usage != (Usage{}) {
+				attrs = append(attrs, "cpu", result.Usage.CPUTime(), "max_rss", result.Usage.MaxRSS)
+			}
+			if result.Error != nil {
+				attrs = append(attrs, "error", result.Error)
+			}
+			l.InfoContext(ctx, "Command", attrs...)
+			return result
+		}}
+	}
+}
+
+// DryRun logs commands instead of running them and reports them as
+// successful. PATH lookups still reach the next executor, so conditions
+// behave as they would in a real run.
+func DryRun(l *slog.Logger) Middleware {
+	return func(next CommandExecutor) CommandExecutor {
+		return &interceptor{next: next, run: func(ctx context.Context, cmd Cmd) RunResult {
+			command := commandLine(next, cmd)
+			l.InfoContext(ctx, "Dry run: would run command", "command", command, "elevated", cmd.Sudo)
+			return RunResult{Success: true, Command: command, Elevated: cmd.Sudo}
+		}}
+	}
+}
+
+// Policy decides which commands may run
+type Policy struct {
+	// Allow lists the permitted commands. If empty, every command that is
+	// not denied is permitted.
+	Allow []CmdMatcher
+
+	// Deny lists commands that are rejected even if allowed
+	Deny []CmdMatcher
+}
+
+// DefaultPolicy permits everything except removing the root directory
+var DefaultPolicy = Policy{Deny: []CmdMatcher{MatchRemoveRoot()}}
+
+// Check returns a *PolicyViolationError if cmd may not run
+func (p Policy) Check(cmd Cmd) error {
+	for _, deny := range p.Deny {
+		if deny(cmd) {
+			return &PolicyViolationError{Cmd: cmd, Reason: "denied by policy"}
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, allow := range p.Allow {
+		if allow(cmd) {
+			return nil
+		}
+	}
+	return &PolicyViolationError{Cmd: cmd, Reason: "not on the allowlist"}
+}
+
+// PolicyViolationError is returned for commands rejected by a Policy
+type PolicyViolationError struct {
+	Cmd    Cmd
+	Reason string
+}
+
+func (e *PolicyViolationError) Error() string {
+	return fmt.Sprintf("command %q %s", redact.String(e.Cmd.String()), e.Reason)
+}
+
+// Enforce rejects commands that policy does not permit without running them
+func Enforce(policy Policy) Middleware {
+	return func(next CommandExecutor) CommandExecutor {
+		return &interceptor{next: next, run: func(ctx context.Context, cmd Cmd) RunResult {
+			if err := policy.Check(cmd); err != nil {
+				return RunResult{Success: false, Error: err, Command: commandLine(next, cmd), ExitCode: -1, Elevated: cmd.Sudo}
+			}
+			return next.RunContext(ctx, cmd)
+		}}
+	}
+}
+
+// MatchNames matches commands whose program, without its directory, is one
+// of names
+func MatchNames(names ...string) CmdMatcher {
+	return func(cmd Cmd) bool {
+		base := filepath.Base(cmd.Name)
+		for _, name := range names {
+			if base == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchRemoveRoot matches recursive rm commands with / or /* as a target.
+// Commands hidden inside shell snippets are not detected.
+func MatchRemoveRoot() CmdMatcher {
+	isRm := MatchNames("rm")
+	return func(cmd Cmd) bool {
+		if !isRm(cmd) {
+			return false
+		}
+		recursive, root := false, false
+		for _, arg := range cmd.Args {
+			switch {
+			case arg == "--recursive":
+				recursive = true
+			case strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--"):
+				recursive = recursive || strings.ContainsAny(arg, "rR")
+			case filepath.Clean(arg) == "/" || arg == "/*":
+				root = true
+			}
+		}
+		return recursive && root
+	}
+}
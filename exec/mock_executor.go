@@ -1,6 +1,12 @@
 package exec
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"time"
+
 	"github.com/stretchr/testify/mock"
 )
 
@@ -15,6 +21,22 @@ func (m *MockExecutor) Run(name string, args ...string) RunResult {
 	return callArgs.Get(0).(RunResult)
 }
 
+// RunContext mocks context-aware command execution. Stdin is read up front
+// so matchers can inspect it. The result is marked Elevated if cmd.Sudo is set.
+func (m *MockExecutor) RunContext(ctx context.Context, cmd Cmd) RunResult {
+	if cmd.Stdin != nil {
+		data, err := io.ReadAll(cmd.Stdin)
+		if err != nil {
+			return RunResult{Success: false, Error: err}
+		}
+		cmd.Stdin = bytes.NewReader(data)
+	}
+	callArgs := m.Called(ctx, cmd)
+	result := callArgs.Get(0).(RunResult)
+	result.Elevated = cmd.Sudo
+	return result
+}
+
 // LookPath mocks PATH lookup
 func (m *MockExecutor) LookPath(cmd string) (string, error) {
 	args := m.Called(cmd)
@@ -36,6 +58,35 @@ func (m *MockExecutor) ExpectRunFailure(name string, args []string, err error) *
 	return m.ExpectRun(name, args, RunResult{Success: false, Error: err})
 }
 
+// ExpectRunContext sets up an expectation for RunContext with the given
+// command, accepting any context
+func (m *MockExecutor) ExpectRunContext(cmd Cmd, result RunResult) *mock.Call {
+	return m.On("RunContext", mock.Anything, cmd).Return(result)
+}
+
+// ExpectRunContextSuccess sets up an expectation for a successful RunContext
+func (m *MockExecutor) ExpectRunContextSuccess(cmd Cmd) *mock.Call {
+	return m.ExpectRunContext(cmd, RunResult{Success: true})
+}
+
+// ExpectRunContextFailure sets up an expectation for a failed RunContext
+func (m *MockExecutor) ExpectRunContextFailure(cmd Cmd, err error) *mock.Call {
+	return m.ExpectRunContext(cmd, RunResult{Success: false, Error: err})
+}
+
+// ExpectCmd sets up an expectation for RunContext with a command that
+// satisfies all matchers
+func (m *MockExecutor) ExpectCmd(result RunResult, matchers ...CmdMatcher) *mock.Call {
+	return m.On("RunContext", mock.Anything, mock.MatchedBy(func(cmd Cmd) bool {
+		for _, match := range matchers {
+			if !match(cmd) {
+				return false
+			}
+		}
+		return true
+	})).Return(result)
+}
+
 // ExpectLookPath sets up an expectation for LookPath
 func (m *MockExecutor) ExpectLookPath(cmd string, path string, err error) *mock.Call {
 	return m.On("LookPath", cmd).Return(path, err)
@@ -51,6 +102,52 @@ func (m *MockExecutor) ExpectCommandNotFound(cmd string) *mock.Call {
 	return m.ExpectLookPath(cmd, "", &CommandNotFoundError{Cmd: cmd})
 }
 
+// CmdMatcher reports whether a command matches an expectation
+type CmdMatcher func(Cmd) bool
+
+// MatchName matches commands with the given program name
+func MatchName(name string) CmdMatcher {
+	return func(cmd Cmd) bool { return cmd.Name == name }
+}
+
+// MatchArgs matches commands with exactly the given arguments
+func MatchArgs(args ...string) CmdMatcher {
+	return func(cmd Cmd) bool { return slices.Equal(cmd.Args, args) }
+}
+
+// MatchDir matches commands run in the given working directory
+func MatchDir(dir string) CmdMatcher {
+	return func(cmd Cmd) bool { return cmd.Dir == dir }
+}
+
+// MatchEnv matches commands whose Env contains the given "KEY=value" entry
+func MatchEnv(entry string) CmdMatcher {
+	return func(cmd Cmd) bool { return slices.Contains(cmd.Env, entry) }
+}
+
+// MatchStdin matches commands whose standard input is exactly content
+func MatchStdin(content string) CmdMatcher {
+	return func(cmd Cmd) bool {
+		r, ok := cmd.Stdin.(io.ReadSeeker)
+		if !ok {
+			return content == "" && cmd.Stdin == nil
+		}
+		data, err := io.ReadAll(r)
+		r.Seek(0, io.SeekStart)
+		return err == nil && string(data) == content
+	}
+}
+
+// MatchTimeout matches commands with the given timeout
+func MatchTimeout(timeout time.Duration) CmdMatcher {
+	return func(cmd Cmd) bool { return cmd.Timeout == timeout }
+}
+
+// MatchSudo matches commands that do or do not run through sudo
+func MatchSudo(sudo bool) CmdMatcher {
+	return func(cmd Cmd) bool { return cmd.Sudo == sudo }
+}
+
 // CommandNotFoundError is returned when a command is not found in PATH
 type CommandNotFoundError struct {
 	Cmd string
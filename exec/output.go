@@ -0,0 +1,225 @@
+package exec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cwood/dotgraph/redact"
+)
+
+// DefaultMaxOutput is the number of bytes of each output stream kept in
+// memory when RealExecutor.MaxOutput is not set
+const DefaultMaxOutput = 1 << 20
+
+// DefaultTailOutput is the number of bytes at the end of each output stream
+// kept in a RunResult once the output has spilled to disk, when
+// RealExecutor.TailOutput is not set
+const DefaultTailOutput = 64 << 10
+
+// binarySniffLen is how much output is checked for NUL bytes to decide
+// whether it is binary, like git does
+const binarySniffLen = 8000
+
+// spillBuffer captures an output stream. It keeps up to limit bytes in
+// memory and moves everything to a temporary file beyond that, while a ring
+// buffer keeps the last bytes for RunResult. Close removes the file.
+type spillBuffer struct {
+	limit    int
+	mem      bytes.Buffer
+	file     *os.File
+	size     int64
+	binary   bool
+	tailSize int
+
+	// tail is allocated once the output outgrows limit
+	tail *ringBuffer
+
+	// lost counts bytes that could not be written to the spill file
+	lost int64
+}
+
+func newSpillBuffer(limit, tail int) *spillBuffer {
+	return &spillBuffer{limit: limit, tailSize: tail}
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.size < binarySniffLen {
+		sniff := p[:min(len(p), binarySniffLen-int(b.size))]
+		b.binary = b.binary || bytes.IndexByte(sniff, 0) >= 0
+	}
+	b.size += int64(len(p))
+	if b.tail != nil {
+		b.tail.Write(p)
+	}
+
+	if b.file == nil && b.mem.Len()+len(p) <= b.limit {
+		b.mem.Write(p)
+		return len(p), nil
+	}
+	if b.tail == nil {
+		b.tail = newRingBuffer(b.tailSize)
+		b.tail.Write(b.mem.Bytes())
+		b.tail.Write(p)
+	}
+	if b.file == nil && b.lost == 0 {
+		b.spill()
+	}
+	if b.file == nil {
+		b.lost += int64(len(p))
+		return len(p), nil
+	}
+	if _, err := b.file.Write(p); err != nil {
+		b.lost += int64(len(p))
+	}
+	return len(p), nil
+}
+
+// spill moves the buffered output to a temporary file
+func (b *spillBuffer) spill() {
+	f, err := os.CreateTemp("", "dotgraph-output-*")
+	if err == nil {
+		_, err = b.mem.WriteTo(f)
+	}
+	if err != nil {
+		// Keep what is in memory and count the rest as lost
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		return
+	}
+	b.file = f
+	b.mem = bytes.Buffer{}
+}
+
+// String returns the whole output if it fits in memory, or the tail after
+// a truncation marker
+func (b *spillBuffer) String() string {
+	if b.file == nil && b.lost == 0 {
+		return b.mem.String()
+	}
+	tail := b.tail.Bytes()
+	if omitted := b.size - int64(len(tail)); omitted > 0 {
+		return fmt.Sprintf("[... truncated %d bytes]\n", omitted) + string(tail)
+	}
+	return string(tail)
+}
+
+// WriteTo writes the whole output to w, reading back the spill file.
+// Binary output is summarized instead.
+func (b *spillBuffer) WriteTo(w io.Writer) (int64, error) {
+	if b.binary {
+		n, err := fmt.Fprintf(w, "[binary output, %d bytes]\n", b.size)
+		return int64(n), err
+	}
+	if b.file == nil {
+		n, err := w.Write(b.mem.Bytes())
+		if err == nil && b.lost > 0 {
+			var m int
+			m, err = fmt.Fprintf(w, "\n[... %d bytes lost]\n", b.lost)
+			n += m
+		}
+		return int64(n), err
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, b.file)
+}
+
+// Close removes the spill file
+func (b *spillBuffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// ringBuffer keeps the last bytes written to it
+type ringBuffer struct {
+	buf  []byte
+	next int
+	full bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, size)}
+}
+
+func (r *ringBuffer) Write(p []byte) {
+	size := len(r.buf)
+	if size == 0 {
+		return
+	}
+	if len(p) >= size {
+		copy(r.buf, p[len(p)-size:])
+		r.next, r.full = 0, true
+		return
+	}
+	n := copy(r.buf[r.next:], p)
+	if n < len(p) {
+		copy(r.buf, p[n:])
+		r.full = true
+	}
+	r.next = (r.next + len(p)) % size
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Bytes returns the kept bytes in the order they were written
+func (r *ringBuffer) Bytes() []byte {
+	if !r.full {
+		return bytes.Clone(r.buf[:r.next])
+	}
+	return append(bytes.Clone(r.buf[r.next:]), r.buf[:r.next]...)
+}
+
+// maxRedactLine is the longest partial line redactWriter holds back before
+// redacting and writing it anyway
+const maxRedactLine = 64 << 10
+
+// redactWriter masks secrets line by line in what is written through it.
+// Flush must be called to write a final line without a newline.
+type redactWriter struct {
+	w        io.Writer
+	redactor *redact.Redactor
+	line     []byte
+}
+
+func newRedactWriter(w io.Writer, r *redact.Redactor) *redactWriter {
+	return &redactWriter{w: w, redactor: r}
+}
+
+func (rw *redactWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			rw.line = append(rw.line, p...)
+			if len(rw.line) >= maxRedactLine {
+				return n, rw.Flush()
+			}
+			return n, nil
+		}
+		rw.line = append(rw.line, p[:i+1]...)
+		p = p[i+1:]
+		if err := rw.Flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Flush writes the held back partial line
+func (rw *redactWriter) Flush() error {
+	if len(rw.line) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(rw.w, rw.redactor.String(string(rw.line)))
+	rw.line = rw.line[:0]
+	return err
+}
@@ -0,0 +1,75 @@
+package exec
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/cwood/dotgraph/redact"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingBuffer(t *testing.T) {
+	ring := newRingBuffer(5)
+	ring.Write([]byte("ab"))
+	assert.Equal(t, "ab", string(ring.Bytes()))
+
+	ring.Write([]byte("cde"))
+	assert.Equal(t, "abcde", string(ring.Bytes()))
+
+	ring.Write([]byte("fg"))
+	assert.Equal(t, "cdefg", string(ring.Bytes()))
+
+	ring.Write([]byte("0123456789"))
+	assert.Equal(t, "56789", string(ring.Bytes()))
+
+	ring.Write([]byte("x"))
+	assert.Equal(t, "6789x", string(ring.Bytes()))
+}
+
+func TestSpillBuffer(t *testing.T) {
+	b := newSpillBuffer(8, 4)
+	defer b.Close()
+
+	b.Write([]byte("hello "))
+	assert.Equal(t, "hello ", b.String())
+	assert.Nil(t, b.file)
+	assert.Nil(t, b.tail)
+
+	b.Write([]byte("world"))
+	assert.NotNil(t, b.file)
+	assert.Equal(t, "[... truncated 7 bytes]\norld", b.String())
+
+	var full bytes.Buffer
+	b.WriteTo(&full)
+	assert.Equal(t, "hello world", full.String())
+}
+
+func TestSpillBuffer_TailKeepsBufferedOutput(t *testing.T) {
+	b := newSpillBuffer(8, 10)
+	defer b.Close()
+
+	b.Write([]byte("hello "))
+	b.Write([]byte("world"))
+	b.Write([]byte("!"))
+	assert.Equal(t, "[... truncated 2 bytes]\nllo world!", b.String())
+}
+
+func TestRedactWriter(t *testing.T) {
+	r := redact.New()
+	r.AddSecret("hunter22")
+	var out bytes.Buffer
+	rw := newRedactWriter(&out, r)
+
+	// The secret is split across writes
+	rw.Write([]byte("pass: hun"))
+	rw.Write([]byte("ter22\nnext line"))
+	assert.Equal(t, "pass: [REDACTED]\n", out.String())
+
+	rw.Flush()
+	assert.Equal(t, "pass: [REDACTED]\nnext line", out.String())
+
+	out.Reset()
+	rw.Write([]byte(strings.Repeat("x", maxRedactLine)))
+	assert.Equal(t, maxRedactLine, out.Len())
+}
@@ -0,0 +1,116 @@
+package exec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PolicyFile is the YAML form of a Policy. Each section maps a program name
+// to glob patterns for its space-joined arguments; an empty list matches
+// any arguments, and * matches any run of characters, spaces included:
+//
+//	allow:
+//	  git: ["clone *", "pull", "-C * pull"]
+//	  pacman: ["-S --needed *"]
+//	  stow: []
+//	deny:
+//	  git: ["push *"]
+//
+// When allow is present, programs it does not list are rejected.
+type PolicyFile struct {
+	Allow map[string][]string `yaml:"allow"`
+	Deny  map[string][]string `yaml:"deny"`
+}
+
+// LoadPolicy reads a policy file
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := ParsePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return policy, nil
+}
+
+// ParsePolicy parses a policy file's contents
+func ParsePolicy(data []byte) (*Policy, error) {
+	var file PolicyFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse policy: %w", err)
+	}
+	return file.Policy()
+}
+
+// Policy converts the file into a Policy
+func (f PolicyFile) Policy() (*Policy, error) {
+	allow, err := globMatchers(f.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	deny, err := globMatchers(f.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return &Policy{Allow: allow, Deny: deny}, nil
+}
+
+// globMatchers builds one matcher per pattern, or one per program that
+// matches any arguments when its list is empty
+func globMatchers(rules map[string][]string) ([]CmdMatcher, error) {
+	var matchers []CmdMatcher
+	for name, patterns := range rules {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid program name %q", name)
+		}
+		if len(patterns) == 0 {
+			matchers = append(matchers, MatchNames(name))
+		}
+		for _, pattern := range patterns {
+			matchers = append(matchers, MatchGlob(name, pattern))
+		}
+	}
+	return matchers, nil
+}
+
+// MatchGlob matches commands whose program, without its directory, is name
+// and whose space-joined arguments match the glob pattern. * matches any
+// run of characters and ? any single character.
+func MatchGlob(name, pattern string) CmdMatcher {
+	isName := MatchNames(name)
+	args := GlobRegexp(pattern)
+	return func(cmd Cmd) bool {
+		return isName(cmd) && args.MatchString(strings.Join(cmd.Args, " "))
+	}
+}
+
+// GlobRegexp converts a glob pattern into an anchored regular expression.
+// * matches any run of characters, spaces and newlines included, and ?
+// matches one, so multi-line arguments cannot slip past a pattern.
+func GlobRegexp(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
@@ -0,0 +1,95 @@
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicyYAML = `
+allow:
+  git: ["clone *", "pull", "-C * pull"]
+  pacman: ["-S --needed *"]
+  stow: []
+deny:
+  git: ["clone *evil*"]
+`
+
+func TestParsePolicy(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicyYAML))
+	require.NoError(t, err)
+
+	allowed := []Cmd{
+		{Name: "git", Args: []string{"clone", "https://example.com/dots.git", "/home/me/dots"}},
+		{Name: "git", Args: []string{"pull"}},
+		{Name: "/usr/bin/git", Args: []string{"-C", "/home/me/dots", "pull"}},
+		{Name: "pacman", Args: []string{"-S", "--needed", "git", "stow"}, Sudo: true},
+		{Name: "stow", Args: []string{"-t", "/home/me", "nvim"}},
+	}
+	for _, cmd := range allowed {
+		assert.NoError(t, policy.Check(cmd), cmd.String())
+	}
+
+	err = policy.Check(Cmd{Name: "git", Args: []string{"push", "--force"}})
+	assert.EqualError(t, err, `command "git push --force" not on the allowlist`)
+	err = policy.Check(Cmd{Name: "curl", Args: []string{"https://example.com/install.sh"}})
+	assert.EqualError(t, err, `command "curl https://example.com/install.sh" not on the allowlist`)
+	err = policy.Check(Cmd{Name: "git", Args: []string{"clone", "https://evil.example.com/x"}})
+	var violation *PolicyViolationError
+	require.ErrorAs(t, err, &violation)
+	assert.Equal(t, "denied by policy", violation.Reason)
+}
+
+func TestParsePolicy_DenyOnly(t *testing.T) {
+	policy, err := ParsePolicy([]byte("deny:\n  rm: []\n"))
+	require.NoError(t, err)
+
+	assert.NoError(t, policy.Check(Cmd{Name: "git", Args: []string{"status"}}))
+	assert.Error(t, policy.Check(Cmd{Name: "rm", Args: []string{"-f", "x"}}))
+}
+
+func TestParsePolicy_MultiLineArgs(t *testing.T) {
+	policy, err := ParsePolicy([]byte("deny:\n  sh: [\"-c *rm -rf*\"]\n"))
+	require.NoError(t, err)
+
+	assert.Error(t, policy.Check(Cmd{Name: "sh", Args: []string{"-c", "rm -rf ~/x"}}))
+	assert.Error(t, policy.Check(Cmd{Name: "sh", Args: []string{"-c", "echo hi\nrm -rf ~/x"}}))
+	assert.NoError(t, policy.Check(Cmd{Name: "sh", Args: []string{"-c", "echo hi\nls"}}))
+}
+
+func TestParsePolicy_Empty(t *testing.T) {
+	policy, err := ParsePolicy(nil)
+	require.NoError(t, err)
+	assert.NoError(t, policy.Check(Cmd{Name: "anything"}))
+}
+
+func TestParsePolicy_Errors(t *testing.T) {
+	_, err := ParsePolicy([]byte("allow:\n  git: [clone]\nalow: {}\n"))
+	assert.ErrorContains(t, err, "field alow not found")
+
+	_, err = ParsePolicy([]byte("deny:\n  /bin/rm: []\n"))
+	assert.EqualError(t, err, `deny: invalid program name "/bin/rm"`)
+}
+
+func TestLoadPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testPolicyYAML), 0644))
+
+	policy, err := LoadPolicy(path)
+	require.NoError(t, err)
+	assert.NoError(t, policy.Check(Cmd{Name: "git", Args: []string{"pull"}}))
+
+	_, err = LoadPolicy(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestMatchGlob(t *testing.T) {
+	match := MatchGlob("git", "clone ?*")
+
+	assert.True(t, match(Cmd{Name: "git", Args: []string{"clone", "url"}}))
+	assert.False(t, match(Cmd{Name: "git", Args: []string{"clone"}}))
+	assert.False(t, match(Cmd{Name: "hg", Args: []string{"clone", "url"}}))
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package exec
+
+import (
+	"os"
+	"os/exec"
+	"time"
+)
+
+// setProcessGroup only bounds how long a cancelled command may take to exit;
+// process groups are not available on this platform
+func setProcessGroup(cmd *exec.Cmd, grace time.Duration) (cleanup func()) {
+	cmd.WaitDelay = grace
+	return func() {}
+}
+
+// maxRSS is not available on this platform
+func maxRSS(state *os.ProcessState) int64 {
+	return 0
+}
@@ -0,0 +1,74 @@
+//go:build unix
+
+package exec
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// setProcessGroup starts the command in its own process group and makes
+// cancellation signal the whole group: SIGTERM first, then SIGKILL once the
+// grace period has passed. The returned function must be called after the
+// command has exited.
+func setProcessGroup(cmd *exec.Cmd, grace time.Duration) (cleanup func()) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if !cmd.SysProcAttr.Setsid {
+		cmd.SysProcAttr.Setpgid = true
+	}
+
+	var mu sync.Mutex
+	var killTimer *time.Timer
+	exited := false
+
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		if err := syscall.Kill(-pgid, syscall.SIGTERM); err != nil {
+			if errors.Is(err, syscall.ESRCH) {
+				return os.ErrProcessDone
+			}
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if !exited {
+			killTimer = time.AfterFunc(grace, func() {
+				syscall.Kill(-pgid, syscall.SIGKILL)
+			})
+		}
+		return nil
+	}
+	// Give the group kill a head start before os/exec kills the leader
+	// and stops waiting for output
+	cmd.WaitDelay = grace + time.Second
+
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		exited = true
+		if killTimer != nil {
+			killTimer.Stop()
+		}
+	}
+}
+
+// maxRSS returns the peak resident set size of an exited process in bytes
+func maxRSS(state *os.ProcessState) int64 {
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	// Darwin reports bytes, the other systems kilobytes
+	if runtime.GOOS == "darwin" || runtime.GOOS == "ios" {
+		return int64(rusage.Maxrss)
+	}
+	return int64(rusage.Maxrss) * 1024
+}
@@ -0,0 +1,206 @@
+//go:build linux
+
+package exec
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ptySupported reports whether commands can run under a pseudo-terminal
+const ptySupported = true
+
+// openPTY opens a new pseudo-terminal through /dev/ptmx. The master is
+// non-blocking so closing it interrupts a pending read.
+func openPTY() (master, slave *os.File, err error) {
+	fd, err := syscall.Open("/dev/ptmx", syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open /dev/ptmx: %w", err)
+	}
+
+	var unlock int32
+	if err := ioctl(fd, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		syscall.Close(fd)
+		return nil, nil, fmt.Errorf("unlock pty: %w", err)
+	}
+	var n uint32
+	if err := ioctl(fd, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		syscall.Close(fd)
+		return nil, nil, fmt.Errorf("get pty number: %w", err)
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+	master = os.NewFile(uintptr(fd), "/dev/ptmx")
+
+	slaveName := fmt.Sprintf("/dev/pts/%d", n)
+	slave, err = os.OpenFile(slaveName, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("open %s: %w", slaveName, err)
+	}
+	return master, slave, nil
+}
+
+// isTerminal reports whether fd refers to a terminal
+func isTerminal(fd int) bool {
+	var termios syscall.Termios
+	return ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&termios))) == nil
+}
+
+// makeRaw puts the terminal into raw mode and returns a function that
+// restores the previous state
+func makeRaw(fd int) (restore func(), err error) {
+	var old syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&old))); err != nil {
+		return nil, err
+	}
+
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&raw))); err != nil {
+		return nil, err
+	}
+	return func() {
+		ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&old)))
+	}, nil
+}
+
+// copyWindowSize gives the pty the same size as the terminal at fd
+func copyWindowSize(from int, to *os.File) {
+	var ws [4]uint16
+	if ioctl(from, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))) != nil {
+		return
+	}
+	if raw, err := to.SyscallConn(); err == nil {
+		raw.Control(func(fd uintptr) {
+			ioctl(int(fd), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+		})
+	}
+}
+
+func ioctl(fd int, req uint, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(req), arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// terminal is the user's terminal that a pty command is attached to
+type terminal struct {
+	in  *os.File
+	out io.Writer
+}
+
+// userTerminal returns the process's terminal if stdin is one, or nil
+func userTerminal() *terminal {
+	if !isTerminal(int(os.Stdin.Fd())) {
+		return nil
+	}
+	return &terminal{in: os.Stdin, out: os.Stdout}
+}
+
+// runPTY runs cmd with a pseudo-terminal as its stdin, stdout and stderr.
+// Everything the command prints is written to out. If term is not nil, its
+// input is forwarded to the command in raw mode and the output is shown on it.
+func runPTY(cmd *exec.Cmd, out io.Writer, term *terminal) error {
+	master, slave, err := openPTY()
+	if err != nil {
+		return err
+	}
+	defer master.Close()
+
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = false
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+
+	if term != nil {
+		out = io.MultiWriter(out, term.out)
+		copyWindowSize(int(term.in.Fd()), master)
+	}
+
+	err = cmd.Start()
+	slave.Close()
+	if err != nil {
+		return err
+	}
+
+	if term != nil {
+		stop := forwardTerminal(term, master)
+		defer stop()
+	}
+
+	copied := make(chan struct{})
+	go func() {
+		// Reading fails with EIO once the command has closed the pty
+		io.Copy(out, master)
+		close(copied)
+	}()
+
+	err = cmd.Wait()
+
+	// Background processes may keep the pty open; don't wait for them
+	select {
+	case <-copied:
+	case <-time.After(time.Second):
+	}
+	master.Close()
+	<-copied
+	return err
+}
+
+// forwardTerminal puts the terminal in raw mode, copies its input to the
+// pty and keeps the pty size in sync. The returned function undoes this.
+func forwardTerminal(term *terminal, master *os.File) (stop func()) {
+	inFd := int(term.in.Fd())
+	restore, err := makeRaw(inFd)
+	if err != nil {
+		restore = func() {}
+	}
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			copyWindowSize(inFd, master)
+		}
+	}()
+
+	// Read from a non-blocking duplicate of stdin so the copy can be
+	// stopped by closing it once the command exits
+	var input *os.File
+	if dup, err := syscall.Dup(inFd); err == nil {
+		syscall.SetNonblock(dup, true)
+		input = os.NewFile(uintptr(dup), "stdin")
+		go io.Copy(master, input)
+	}
+
+	return func() {
+		signal.Stop(winch)
+		close(winch)
+		if input != nil {
+			// The duplicate shares its file status flags with stdin
+			syscall.SetNonblock(inFd, false)
+			input.Close()
+		}
+		restore()
+	}
+}
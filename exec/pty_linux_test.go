@@ -0,0 +1,52 @@
+//go:build linux
+
+package exec
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunPTY_CommandSeesTerminal(t *testing.T) {
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip("no /dev/ptmx")
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", "test -t 0 && test -t 1 && echo tty; echo err >&2")
+
+	err := runPTY(cmd, &out, nil)
+
+	require.NoError(t, err)
+	assert.Equal(t, "tty\r\nerr\r\n", out.String())
+}
+
+func TestRunPTY_ExitCode(t *testing.T) {
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip("no /dev/ptmx")
+	}
+
+	cmd := exec.Command("sh", "-c", "exit 3")
+
+	err := runPTY(cmd, &bytes.Buffer{}, nil)
+
+	require.Error(t, err)
+	assert.Equal(t, 3, cmd.ProcessState.ExitCode())
+}
+
+func TestRealExecutor_RunContext_PTYFallsBackWithoutTerminal(t *testing.T) {
+	if isTerminal(int(os.Stdin.Fd())) {
+		t.Skip("stdin is a terminal")
+	}
+	executor := &RealExecutor{LogDir: t.TempDir()}
+
+	result := executor.RunContext(t.Context(), Cmd{Name: "sh", Args: []string{"-c", "test -t 1 || echo pipe"}, PTY: true})
+
+	require.True(t, result.Success)
+	assert.Equal(t, "pipe\n", result.Stdout)
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package exec
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+)
+
+// ptySupported reports whether commands can run under a pseudo-terminal
+const ptySupported = false
+
+// terminal is the user's terminal that a pty command is attached to
+type terminal struct{}
+
+// userTerminal returns nil because pseudo-terminals are not supported
+func userTerminal() *terminal {
+	return nil
+}
+
+// runPTY is not supported on this platform
+func runPTY(cmd *exec.Cmd, out io.Writer, term *terminal) error {
+	return errors.New("pseudo-terminals are not supported on this platform")
+}
@@ -0,0 +1,79 @@
+package exec
+
+import (
+	"strings"
+	"time"
+)
+
+// RunResult contains the result of running a command
+type RunResult struct {
+	Success bool
+	LogFile string
+	Error   error
+
+	// Command is the command line that was run
+	Command string
+
+	// Stdout and Stderr hold the captured output. Output beyond the
+	// executor's limit loses its head: only the last TailOutput bytes are
+	// kept, after a leading "[... truncated N bytes]" marker, and the full
+	// output is spilled to disk for the failure log.
+	Stdout string
+	Stderr string
+
+	// ExitCode is the process exit code, or -1 if the command did not
+	// start or was killed by a signal
+	ExitCode int
+
+	// Duration is how long the command ran
+	Duration time.Duration
+
+	// Queued is how long the command waited for Throttle limits before it
+	// started. It is not part of Duration.
+	Queued time.Duration
+
+	// Elevated is true if the command was run as root
+	Elevated bool
+
+	// Usage is the resources the command used, when it started
+	Usage Usage
+}
+
+// Usage is the CPU time and memory used by commands
+type Usage struct {
+	// UserTime and SystemTime are the CPU time spent in user and kernel
+	// mode, including child processes the command waited for
+	UserTime   time.Duration `json:"user_time"`
+	SystemTime time.Duration `json:"system_time"`
+
+	// MaxRSS is the peak resident set size in bytes of the largest
+	// process. It is zero where the platform does not report it.
+	MaxRSS int64 `json:"max_rss"`
+}
+
+// CPUTime returns the total CPU time
+func (u Usage) CPUTime() time.Duration {
+	return u.UserTime + u.SystemTime
+}
+
+// Add adds the CPU time of other and keeps the larger MaxRSS
+func (u *Usage) Add(other Usage) {
+	u.UserTime += other.UserTime
+	u.SystemTime += other.SystemTime
+	u.MaxRSS = max(u.MaxRSS, other.MaxRSS)
+}
+
+// Trimmed returns Stdout without leading and trailing whitespace, for
+// commands like `brew --prefix` that print a single value
+func (r RunResult) Trimmed() string {
+	return strings.TrimSpace(r.Stdout)
+}
+
+// Lines returns Stdout split into lines, without the trailing newline
+func (r RunResult) Lines() []string {
+	out := strings.TrimRight(r.Stdout, "\n")
+	if out == "" {
+		return nil
+	}
+	return strings.Split(out, "\n")
+}
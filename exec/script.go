@@ -0,0 +1,203 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Script is a shell snippet to run with RunScriptContext
+type Script struct {
+	// Shell runs the script. bash runs it with -Eeuo pipefail and reports
+	// the line that failed; other shells, such as sh and zsh, run it with
+	// -eu. If empty, bash is used.
+	Shell string
+
+	// Text is the script
+	Text string
+
+	// File passes the script in a temporary file instead of on standard
+	// input. The file is only visible to executors on this machine.
+	File bool
+
+	// Dir, Env, Timeout, Sudo and OnLine are passed on to the Cmd
+	Dir     string
+	Env     []string
+	Timeout time.Duration
+	Sudo    bool
+	OnLine  LineHandler
+}
+
+// ScriptError is returned for a script that failed at a known line
+type ScriptError struct {
+	// Line is the failing line of the script, counting from 1
+	Line int
+
+	// Source is the text of the failing line
+	Source string
+
+	// Err is the error of the shell process
+	Err error
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("script failed at line %d: %s: %v", e.Line, strings.TrimSpace(e.Source), e.Err)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// RunScript runs a shell snippet with executor in strict mode
+func RunScript(executor CommandExecutor, shell, script string) RunResult {
+	return RunScriptContext(context.Background(), executor, Script{Shell: shell, Text: script})
+}
+
+// Cmd returns the command RunScriptContext runs for s, with the script on
+// standard input. For a File script, the temporary file is passed in place
+// of -s.
+func (s Script) Cmd() Cmd {
+	args := append(s.flags(), "-s")
+	return Cmd{
+		Name:    s.shell(),
+		Args:    args,
+		Dir:     s.Dir,
+		Env:     s.Env,
+		Stdin:   strings.NewReader(s.wrapped()),
+		Timeout: s.Timeout,
+		Sudo:    s.Sudo,
+		OnLine:  s.OnLine,
+	}
+}
+
+// shell returns the configured shell or bash
+func (s Script) shell() string {
+	if s.Shell == "" {
+		return "bash"
+	}
+	return s.Shell
+}
+
+// flags returns the options that put the shell in strict mode
+func (s Script) flags() []string {
+	if strictShell(s.shell()) {
+		return []string{"-Eeuo", "pipefail"}
+	}
+	return []string{"-eu"}
+}
+
+// wrapped returns the text with the line reporting of strict shells added
+func (s Script) wrapped() string {
+	return wrapScript(s.Text, strictShell(s.shell()))
+}
+
+// RunScriptContext runs a shell script with executor in strict mode. When
+// the script fails, the error is a *ScriptError if the failing line is
+// known, and the failure log ends with the numbered script.
+//
+// The script is read as a whole before it runs, so commands in it that read
+// standard input see end of file rather than the rest of the script.
+func RunScriptContext(ctx context.Context, executor CommandExecutor, s Script) RunResult {
+	cmd := s.Cmd()
+	if s.File {
+		path, err := writeScriptFile(s.wrapped())
+		if err != nil {
+			return RunResult{Error: err, Command: cmd.String(), ExitCode: -1, Elevated: s.Sudo}
+		}
+		defer os.Remove(path)
+		cmd.Args[len(cmd.Args)-1] = path
+		cmd.Stdin = nil
+	}
+	lines := strings.Split(strings.TrimSuffix(s.Text, "\n"), "\n")
+	cmd.logSection = scriptSection(s.shell()+" "+strings.Join(s.flags(), " "), lines)
+
+	result := executor.RunContext(ctx, cmd)
+	if result.Success {
+		return result
+	}
+
+	line := failedLine(result.Stderr)
+	if line > 0 && line <= len(lines) {
+		result.Error = &ScriptError{Line: line, Source: lines[line-1], Err: result.Error}
+	}
+	return result
+}
+
+// strictShell reports whether shell takes -Eeuo pipefail, with -E making
+// functions inherit the ERR trap. zsh reads -E as an unrelated option.
+func strictShell(shell string) bool {
+	return filepath.Base(shell) == "bash"
+}
+
+// scriptOffset is how many lines wrapScript puts before the script
+const scriptOffset = 2
+
+// scriptMarker starts the line the ERR trap writes to stderr
+const scriptMarker = "dotgraph: script failed at line "
+
+// wrapScript puts the script in a group, so the shell parses all of it
+// before running any of it, after an ERR trap that reports the failing line
+func wrapScript(script string, strict bool) string {
+	trap := ":"
+	if strict {
+		trap = fmt.Sprintf(`trap 'echo "%s$((LINENO-%d))" >&2' ERR`, scriptMarker, scriptOffset)
+	}
+	return trap + "\n{\n" + strings.TrimSuffix(script, "\n") + "\n}\n"
+}
+
+// shellLineError matches errors the shell reports itself, such as
+// "bash: line 3: name: unbound variable"
+var shellLineError = regexp.MustCompile(`(?m)^[^:\n]*: line (\d+): `)
+
+// failedLine returns the script line that failed according to stderr, or 0
+func failedLine(stderr string) int {
+	for _, line := range strings.Split(stderr, "\n") {
+		if n, ok := strings.CutPrefix(line, scriptMarker); ok {
+			if line, err := strconv.Atoi(strings.TrimSpace(n)); err == nil {
+				return line
+			}
+		}
+	}
+	if m := shellLineError.FindStringSubmatch(stderr); m != nil {
+		if line, err := strconv.Atoi(m[1]); err == nil {
+			return line - scriptOffset
+		}
+	}
+	return 0
+}
+
+// writeScriptFile writes a script to a temporary file only the user can read
+func writeScriptFile(text string) (string, error) {
+	f, err := os.CreateTemp("", "dotgraph-script-*.sh")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(text); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// scriptSection returns a Cmd.logSection that writes the numbered script,
+// marking the line that failed
+func scriptSection(shell string, lines []string) func(io.Writer, RunResult) {
+	return func(w io.Writer, result RunResult) {
+		failed := failedLine(result.Stderr)
+		fmt.Fprintf(w, "\n=== SCRIPT (%s) ===\n", shell)
+		for i, line := range lines {
+			mark := " "
+			if i+1 == failed {
+				mark = ">"
+			}
+			fmt.Fprintf(w, "%s%4d  %s\n", mark, i+1, line)
+		}
+	}
+}
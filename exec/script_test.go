@@ -0,0 +1,142 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/cwood/dotgraph/redact"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunScript_Success(t *testing.T) {
+	executor := &RealExecutor{LogDir: t.TempDir()}
+
+	result := RunScript(executor, "bash", `cat <<EOF
+hello
+EOF
+read -r line || echo "no input"
+`)
+
+	require.True(t, result.Success, result.Error)
+	assert.Equal(t, "bash -Eeuo pipefail -s", result.Command)
+	assert.Equal(t, "hello\nno input\n", result.Stdout)
+}
+
+func TestRunScript_FailedLine(t *testing.T) {
+	executor := &RealExecutor{LogDir: t.TempDir()}
+	script := `echo start
+check() {
+  grep -q needle /dev/null
+}
+echo haystack | check | cat
+echo unreachable
+`
+
+	result := RunScriptContext(context.Background(), executor, Script{Text: script})
+
+	require.False(t, result.Success)
+	var scriptErr *ScriptError
+	require.ErrorAs(t, result.Error, &scriptErr)
+	assert.Equal(t, 3, scriptErr.Line)
+	assert.Equal(t, "  grep -q needle /dev/null", scriptErr.Source)
+	assert.Equal(t, 1, result.ExitCode)
+	assert.EqualError(t, result.Error, "script failed at line 3: grep -q needle /dev/null: exit status 1")
+	assert.Equal(t, "start\n", result.Stdout)
+
+	content, err := os.ReadFile(result.LogFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "=== SCRIPT (bash -Eeuo pipefail) ===\n    1  echo start\n")
+	assert.Contains(t, string(content), ">   3    grep -q needle /dev/null\n")
+	assert.Contains(t, string(content), "    6  echo unreachable\n")
+}
+
+func TestRunScript_UnboundVariable(t *testing.T) {
+	executor := &RealExecutor{LogDir: t.TempDir()}
+
+	result := RunScript(executor, "bash", "echo ok\necho \"$UNSET_VARIABLE_12345\"\n")
+
+	var scriptErr *ScriptError
+	require.ErrorAs(t, result.Error, &scriptErr)
+	assert.Equal(t, 2, scriptErr.Line)
+}
+
+func TestRunScript_File(t *testing.T) {
+	executor := &RealExecutor{LogDir: t.TempDir()}
+
+	result := RunScriptContext(context.Background(), executor, Script{
+		Text: "echo \"token=hunter22\"\nfalse\n",
+		File: true,
+	})
+
+	var scriptErr *ScriptError
+	require.ErrorAs(t, result.Error, &scriptErr)
+	assert.Equal(t, 2, scriptErr.Line)
+	assert.Regexp(t, `^bash -Eeuo pipefail \S+/dotgraph-script-\d+\.sh$`, result.Command)
+
+	content, err := os.ReadFile(result.LogFile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "hunter22")
+	assert.Contains(t, string(content), `echo "token=[REDACTED]"`)
+}
+
+func TestRunScript_ExecutorRedactor(t *testing.T) {
+	redactor := redact.New()
+	redactor.AddSecret("opensesame")
+	executor := &RealExecutor{LogDir: t.TempDir(), Redactor: redactor}
+
+	result := RunScript(executor, "bash", "echo opensesame >/dev/null\nfalse\n")
+
+	content, err := os.ReadFile(result.LogFile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "opensesame")
+	assert.Contains(t, string(content), "    1  echo [REDACTED] >/dev/null\n>   2  false\n")
+}
+
+func TestRunScript_POSIXShell(t *testing.T) {
+	executor := &RealExecutor{LogDir: t.TempDir()}
+
+	result := RunScript(executor, "sh", "echo before\nfalse\necho after\n")
+
+	require.False(t, result.Success)
+	assert.Equal(t, "sh -eu -s", result.Command)
+	assert.Equal(t, "before\n", result.Stdout)
+	var scriptErr *ScriptError
+	assert.False(t, errors.As(result.Error, &scriptErr))
+
+	content, err := os.ReadFile(result.LogFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "=== SCRIPT (sh -eu) ===\n    1  echo before\n    2  false\n")
+}
+
+func TestRunScript_Executor(t *testing.T) {
+	mockExec := new(MockExecutor)
+	mockExec.ExpectCmd(RunResult{Success: true},
+		MatchName("bash"),
+		MatchArgs("-Eeuo", "pipefail", "-s"),
+		MatchSudo(true),
+		MatchStdin("trap 'echo \"dotgraph: script failed at line $((LINENO-2))\" >&2' ERR\n{\npacman -Syu\n}\n"),
+	)
+
+	result := RunScriptContext(context.Background(), mockExec, Script{Text: "pacman -Syu", Sudo: true})
+
+	assert.True(t, result.Success)
+	mockExec.AssertExpectations(t)
+}
+
+func TestScript_Cmd(t *testing.T) {
+	cmd := Script{Shell: "sh", Text: "echo hi", File: true, Sudo: true}.Cmd()
+
+	assert.Equal(t, "sh", cmd.Name)
+	assert.Equal(t, []string{"-eu", "-s"}, cmd.Args)
+	assert.True(t, cmd.Sudo)
+	stdin, err := io.ReadAll(cmd.Stdin)
+	require.NoError(t, err)
+	assert.Equal(t, ":\n{\necho hi\n}\n", string(stdin))
+
+	assert.Equal(t, []string{"-eu", "-s"}, Script{Shell: "/bin/zsh", Text: "echo hi"}.Cmd().Args)
+	assert.Equal(t, []string{"-Eeuo", "pipefail", "-s"}, Script{Text: "echo hi"}.Cmd().Args)
+}
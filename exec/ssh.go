@@ -0,0 +1,282 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cwood/dotgraph/redact"
+)
+
+// SSHExecutor runs commands on a remote host through the system ssh
+// binary. Connections are shared with ControlMaster, so each command only
+// pays for a new session, not a new handshake.
+//
+// The remote command's exit code is returned as is. ssh itself exits with
+// 255 when it cannot connect, which is reported as a connection error.
+// Elevated commands use "sudo -n" on the remote host, so they need
+// passwordless sudo there.
+type SSHExecutor struct {
+	// Host is the destination, e.g. "root@10.0.0.5" or a Host alias from
+	// ~/.ssh/config
+	Host string
+
+	// Port overrides the port if non-zero
+	Port int
+
+	// IdentityFile is passed to ssh -i if set
+	IdentityFile string
+
+	// Options are extra ssh -o options, e.g. "StrictHostKeyChecking=accept-new"
+	Options []string
+
+	// ControlDir holds the ControlMaster sockets. If empty, a directory
+	// under os.TempDir is used.
+	ControlDir string
+
+	// ControlPersist is how long the shared connection stays open after the
+	// last command. If zero, it stays open for 10 minutes.
+	ControlPersist time.Duration
+
+	// ConnectTimeout is how long ssh waits to connect to the host. If zero,
+	// DefaultSSHConnectTimeout is used.
+	ConnectTimeout time.Duration
+
+	// SSH is the ssh program. If empty, ssh is looked up in PATH.
+	SSH string
+
+	// Local runs the ssh processes, so timeouts, cancellation, output
+	// capture and failure logs work as for local commands. If nil,
+	// Default() is used.
+	Local CommandExecutor
+}
+
+// DefaultSSHConnectTimeout is how long ssh waits to connect when
+// SSHExecutor.ConnectTimeout is zero
+const DefaultSSHConnectTimeout = 30 * time.Second
+
+// sshLookPathTimeout bounds a remote PATH lookup, including connecting
+const sshLookPathTimeout = time.Minute
+
+// NewSSHExecutor creates an SSHExecutor for host
+func NewSSHExecutor(host string) *SSHExecutor {
+	return &SSHExecutor{Host: host}
+}
+
+// Run executes a command on the remote host
+func (s *SSHExecutor) Run(name string, args ...string) RunResult {
+	return s.RunContext(context.Background(), Cmd{Name: name, Args: args})
+}
+
+// RunContext executes a command on the remote host. Dir, Env and Sudo are
+// applied remotely; Stdin, Timeout, OnLine and PTY apply to the local ssh
+// process.
+func (s *SSHExecutor) RunContext(ctx context.Context, c Cmd) RunResult {
+	remote := remoteCommand(c)
+
+	args, err := s.args()
+	if err != nil {
+		return RunResult{Error: err, Command: redact.String(s.Host + ": " + remote), ExitCode: -1, Elevated: c.Sudo}
+	}
+	if c.PTY {
+		args = append(args, "-t")
+	}
+	args = append(args, "--", s.Host, remote)
+
+	result := s.local().RunContext(ctx, Cmd{
+		Name:    s.program(),
+		Args:    args,
+		Stdin:   c.Stdin,
+		Timeout: c.Timeout,
+		OnLine:  c.OnLine,
+		PTY:     c.PTY,
+
+		logSection: c.logSection,
+	})
+	result.Command = redact.String(s.Host + ": " + remote)
+	result.Elevated = c.Sudo
+	if result.ExitCode == 255 {
+		result.Error = fmt.Errorf("ssh %s: connection failed: %s", s.Host, lastLine(result.Stderr))
+	}
+	return result
+}
+
+// LookPath resolves a command on the remote host with `command -v`
+func (s *SSHExecutor) LookPath(name string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sshLookPathTimeout)
+	defer cancel()
+	// A missing command prints nothing rather than failing, so lookups do
+	// not leave failure logs behind
+	out, err := s.output(ctx, nil, "command -v -- "+shellQuote(name)+" || :")
+	if err != nil {
+		return "", err
+	}
+	found := strings.TrimSpace(out)
+	if found == "" {
+		return "", &CommandNotFoundError{Cmd: name}
+	}
+	return strings.SplitN(found, "\n", 2)[0], nil
+}
+
+// Upload writes content to remotePath on the host, creating its directory
+// and setting its permissions
+func (s *SSHExecutor) Upload(ctx context.Context, content io.Reader, remotePath string, mode os.FileMode) error {
+	dir := path.Dir(remotePath)
+	script := fmt.Sprintf("mkdir -p %s && cat > %s && chmod %o %s",
+		shellQuote(dir), shellQuote(remotePath), mode.Perm(), shellQuote(remotePath))
+	if _, err := s.output(ctx, content, script); err != nil {
+		return fmt.Errorf("upload %s to %s: %w", remotePath, s.Host, err)
+	}
+	return nil
+}
+
+// UploadFile copies a local file to remotePath on the host, keeping its
+// permissions
+func (s *SSHExecutor) UploadFile(ctx context.Context, localPath, remotePath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return s.Upload(ctx, f, remotePath, info.Mode())
+}
+
+// Close shuts down the shared connection
+func (s *SSHExecutor) Close() error {
+	args, err := s.args()
+	if err != nil {
+		return err
+	}
+	args = append(args, "-O", "exit", "--", s.Host)
+	// The master may already have exited on its own
+	exec.Command(s.program(), args...).Run()
+	return nil
+}
+
+// output runs a remote shell command through Local and returns its
+// standard output
+func (s *SSHExecutor) output(ctx context.Context, stdin io.Reader, remote string) (string, error) {
+	args, err := s.args()
+	if err != nil {
+		return "", err
+	}
+	args = append(args, "--", s.Host, remote)
+
+	result := s.local().RunContext(ctx, Cmd{Name: s.program(), Args: args, Stdin: stdin})
+	switch {
+	case result.Success:
+		return result.Stdout, nil
+	case result.ExitCode == 255:
+		return result.Stdout, fmt.Errorf("ssh %s: connection failed: %s", s.Host, lastLine(result.Stderr))
+	case lastLine(result.Stderr) != "":
+		return result.Stdout, fmt.Errorf("%w: %s", result.Error, lastLine(result.Stderr))
+	default:
+		return result.Stdout, result.Error
+	}
+}
+
+// args returns the ssh options shared by every invocation
+func (s *SSHExecutor) args() ([]string, error) {
+	controlDir := s.ControlDir
+	if controlDir == "" {
+		controlDir = filepath.Join(os.TempDir(), fmt.Sprintf("dotgraph-ssh-%d", os.Getuid()))
+	}
+	if err := os.MkdirAll(controlDir, 0700); err != nil {
+		return nil, err
+	}
+	persist := s.ControlPersist
+	if persist <= 0 {
+		persist = 10 * time.Minute
+	}
+	connectTimeout := s.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = DefaultSSHConnectTimeout
+	}
+
+	args := []string{
+		"-o", "BatchMode=yes",
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath=" + filepath.Join(controlDir, "%C"),
+		"-o", "ControlPersist=" + strconv.Itoa(int(persist.Seconds())),
+		"-o", "ConnectTimeout=" + strconv.Itoa(int(max(connectTimeout.Seconds(), 1))),
+	}
+	if s.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(s.Port))
+	}
+	if s.IdentityFile != "" {
+		args = append(args, "-i", s.IdentityFile)
+	}
+	for _, option := range s.Options {
+		args = append(args, "-o", option)
+	}
+	return args, nil
+}
+
+func (s *SSHExecutor) program() string {
+	if s.SSH != "" {
+		return s.SSH
+	}
+	return "ssh"
+}
+
+func (s *SSHExecutor) local() CommandExecutor {
+	if s.Local != nil {
+		return s.Local
+	}
+	return Default()
+}
+
+// remoteSudo elevates remote commands without prompting
+var remoteSudo = Escalator{Program: "sudo", Args: []string{"-n", "--"}}
+
+// remoteCommand builds the shell command line that runs c on the remote
+// host. ssh does not forward the environment, so Env is set with env(1).
+func remoteCommand(c Cmd) string {
+	argv := make([]string, 0, len(c.Args)+1)
+	argv = append(argv, c.Name)
+	argv = append(argv, c.Args...)
+	if c.Sudo {
+		argv = remoteSudo.wrap(argv, c.Env)
+	} else if len(c.Env) > 0 {
+		argv = append(append([]string{"env"}, c.Env...), argv...)
+	}
+
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = shellQuote(arg)
+	}
+	command := strings.Join(quoted, " ")
+	if c.Dir != "" {
+		command = "cd " + shellQuote(c.Dir) + " && " + command
+	}
+	return command
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9@%+=:,./_-]+$`)
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// lastLine returns the last non-empty line of s
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
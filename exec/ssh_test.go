@@ -0,0 +1,135 @@
+package exec
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSSH writes an ssh stand-in that runs the remote command with the
+// local shell and logs its arguments
+func fakeSSH(t *testing.T) (program, calls string) {
+	dir := t.TempDir()
+	program = filepath.Join(dir, "ssh")
+	calls = filepath.Join(dir, "calls")
+	require.NoError(t, os.WriteFile(program, []byte(`#!/bin/sh
+echo "$*" >> `+calls+`
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--) shift; break ;;
+	-O) exit 0 ;;
+	-o|-p|-i) shift 2 ;;
+	*) shift ;;
+	esac
+done
+[ "$1" = unreachable ] && { echo "ssh: connect to host unreachable: Connection refused" >&2; exit 255; }
+shift
+exec sh -c "$1"
+`), 0755))
+	return program, calls
+}
+
+func newTestSSHExecutor(t *testing.T, host string) (*SSHExecutor, string) {
+	program, calls := fakeSSH(t)
+	return &SSHExecutor{
+		Host:       host,
+		SSH:        program,
+		ControlDir: filepath.Join(t.TempDir(), "control"),
+		Local:      &RealExecutor{LogDir: t.TempDir()},
+	}, calls
+}
+
+func TestSSHExecutor_RunContext(t *testing.T) {
+	s, calls := newTestSSHExecutor(t, "vm")
+	dir := t.TempDir()
+
+	result := s.RunContext(context.Background(), Cmd{
+		Name:  "sh",
+		Args:  []string{"-c", "pwd; echo \"$GREETING\"; cat"},
+		Dir:   dir,
+		Env:   []string{"GREETING=it's me"},
+		Stdin: strings.NewReader("from stdin\n"),
+	})
+
+	require.True(t, result.Success, result.Error)
+	assert.Equal(t, evalSymlinks(t, dir)+"\nit's me\nfrom stdin\n", result.Stdout)
+	assert.Equal(t, "vm: cd "+dir+" && env 'GREETING=it'\\''s me' sh -c 'pwd; echo \"$GREETING\"; cat'", result.Command)
+
+	data, err := os.ReadFile(calls)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "-o ControlMaster=auto -o ControlPath="+filepath.Join(s.ControlDir, "%C"))
+}
+
+func TestSSHExecutor_RunContext_ExitCode(t *testing.T) {
+	s, _ := newTestSSHExecutor(t, "vm")
+
+	result := s.Run("sh", "-c", "exit 7")
+	unreachable, _ := newTestSSHExecutor(t, "unreachable")
+	failed := unreachable.Run("true")
+
+	assert.False(t, result.Success)
+	assert.Equal(t, 7, result.ExitCode)
+	assert.Equal(t, 255, failed.ExitCode)
+	assert.EqualError(t, failed.Error, "ssh unreachable: connection failed: ssh: connect to host unreachable: Connection refused")
+}
+
+func TestSSHExecutor_LookPath(t *testing.T) {
+	s, _ := newTestSSHExecutor(t, "vm")
+
+	path, err := s.LookPath("sh")
+	require.NoError(t, err)
+	assert.True(t, filepath.IsAbs(path))
+
+	_, err = s.LookPath("nonexistent-command-12345")
+	assert.Equal(t, &CommandNotFoundError{Cmd: "nonexistent-command-12345"}, err)
+
+	unreachable, _ := newTestSSHExecutor(t, "unreachable")
+	_, err = unreachable.LookPath("sh")
+	assert.EqualError(t, err, "ssh unreachable: connection failed: ssh: connect to host unreachable: Connection refused")
+}
+
+func TestSSHExecutor_LookPath_Local(t *testing.T) {
+	mockExec := new(MockExecutor)
+	mockExec.ExpectCmd(RunResult{Success: true, Stdout: "/usr/bin/git\n"},
+		MatchName("ssh"),
+		func(cmd Cmd) bool {
+			return slices.Contains(cmd.Args, "ConnectTimeout=5") && cmd.Args[len(cmd.Args)-1] == "command -v -- git || :"
+		},
+	)
+	s := &SSHExecutor{Host: "vm", ControlDir: t.TempDir(), ConnectTimeout: 5 * time.Second, Local: mockExec}
+
+	path, err := s.LookPath("git")
+
+	require.NoError(t, err)
+	assert.Equal(t, "/usr/bin/git", path)
+	mockExec.AssertExpectations(t)
+}
+
+func TestSSHExecutor_UploadFile(t *testing.T) {
+	s, _ := newTestSSHExecutor(t, "vm")
+	local := filepath.Join(t.TempDir(), "setup.sh")
+	require.NoError(t, os.WriteFile(local, []byte("echo hi\n"), 0755))
+	remote := filepath.Join(t.TempDir(), "new dir", "setup.sh")
+
+	require.NoError(t, s.UploadFile(context.Background(), local, remote))
+
+	data, err := os.ReadFile(remote)
+	require.NoError(t, err)
+	assert.Equal(t, "echo hi\n", string(data))
+	info, err := os.Stat(remote)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+}
+
+func TestRemoteCommand_Sudo(t *testing.T) {
+	command := remoteCommand(Cmd{Name: "pacman", Args: []string{"-S", "git"}, Env: []string{"LANG=C"}, Sudo: true})
+
+	assert.Equal(t, "sudo -n -- env LANG=C pacman -S git", command)
+}
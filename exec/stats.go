@@ -0,0 +1,85 @@
+package exec
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Stats accumulates measurements of the commands run with a context, such
+// as the commands of one pipeline stage. It is safe for concurrent use, and
+// its methods do nothing on a nil Stats.
+type Stats struct {
+	mu       sync.Mutex
+	queued   time.Duration
+	commands int
+	usage    Usage
+}
+
+type statsKey struct{}
+
+// WithStats returns a context that collects Stats for the commands run with
+// it, and the Stats
+func WithStats(ctx context.Context) (context.Context, *Stats) {
+	stats := &Stats{}
+	return context.WithValue(ctx, statsKey{}, stats), stats
+}
+
+// StatsFromContext returns the Stats set with WithStats, or nil
+func StatsFromContext(ctx context.Context) *Stats {
+	stats, _ := ctx.Value(statsKey{}).(*Stats)
+	return stats
+}
+
+// addQueued adds time a command spent waiting before it could start
+func (s *Stats) addQueued(d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued += d
+}
+
+// Queued returns the total time commands waited for concurrency and rate
+// limits before starting
+func (s *Stats) Queued() time.Duration {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queued
+}
+
+// addUsage records the resources used by a command that ran
+func (s *Stats) addUsage(usage Usage) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands++
+	s.usage.Add(usage)
+}
+
+// Commands returns how many commands ran to completion and reported their
+// resource usage
+func (s *Stats) Commands() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands
+}
+
+// Usage returns the total CPU time of the commands and the largest MaxRSS
+func (s *Stats) Usage() Usage {
+	if s == nil {
+		return Usage{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.usage
+}
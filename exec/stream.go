@@ -0,0 +1,108 @@
+package exec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/cwood/dotgraph/redact"
+)
+
+// Stream identifies an output stream of a command
+type Stream string
+
+const (
+	// Stdout is the command's standard output
+	Stdout Stream = "stdout"
+
+	// Stderr is the command's standard error
+	Stderr Stream = "stderr"
+)
+
+// LineHandler receives each line of a command's output as it is produced,
+// without the trailing newline. Calls for one command are serialized.
+type LineHandler func(stream Stream, line string)
+
+// LogLines returns a LineHandler that logs every line at info level, e.g.
+// with a logger tagged with the stage name
+func LogLines(l *slog.Logger) LineHandler {
+	return func(stream Stream, line string) {
+		l.Info(line, "stream", string(stream))
+	}
+}
+
+// WriteLines returns a LineHandler that writes every line to w, preceded by
+// prefix when it is not empty
+func WriteLines(w io.Writer, prefix string) LineHandler {
+	return func(stream Stream, line string) {
+		if prefix != "" {
+			fmt.Fprintf(w, "%s %s\n", prefix, line)
+			return
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// redactLines returns a LineHandler that masks secrets before passing
+// lines to handler
+func redactLines(handler LineHandler, r *redact.Redactor) LineHandler {
+	return func(stream Stream, line string) {
+		handler(stream, r.String(line))
+	}
+}
+
+// maxLineLength is the longest partial line buffered before it is passed
+// on anyway, so output without newlines cannot grow without bound
+const maxLineLength = 64 * 1024
+
+// lineWriter splits written output into lines for a LineHandler
+type lineWriter struct {
+	mu      *sync.Mutex
+	stream  Stream
+	handler LineHandler
+	partial []byte
+}
+
+// newLineWriters returns writers for stdout and stderr that share a lock,
+// so the handler is never called concurrently
+func newLineWriters(handler LineHandler) (stdout, stderr *lineWriter) {
+	mu := &sync.Mutex{}
+	return &lineWriter{mu: mu, stream: Stdout, handler: handler},
+		&lineWriter{mu: mu, stream: Stderr, handler: handler}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(w.partial[:i])
+		w.partial = w.partial[i+1:]
+	}
+	if len(w.partial) >= maxLineLength {
+		w.emit(w.partial)
+		w.partial = w.partial[:0]
+	}
+	return len(p), nil
+}
+
+// Flush passes on a final line that did not end in a newline
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.emit(w.partial)
+		w.partial = nil
+	}
+}
+
+func (w *lineWriter) emit(line []byte) {
+	w.handler(w.stream, string(bytes.TrimSuffix(line, []byte("\r"))))
+}
@@ -0,0 +1,135 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit caps how many matching commands run at once and how often they
+// may start
+type Limit struct {
+	// Name identifies the limit in logs and errors
+	Name string
+
+	// Match selects the commands the limit applies to
+	Match CmdMatcher
+
+	// Max is how many matching commands may run at once. Zero means no cap.
+	Max int
+
+	// Interval is the minimum time between the starts of two matching
+	// commands. Zero means no rate limit.
+	Interval time.Duration
+}
+
+// MaxConcurrent limits commands whose program, without its directory, is
+// one of names to max running at once
+func MaxConcurrent(max int, names ...string) Limit {
+	return Limit{Name: strings.Join(names, ","), Match: MatchNames(names...), Max: max}
+}
+
+// Throttle holds commands back until every limit that matches them has
+// room. Commands acquire their limits in the order given, so overlapping
+// limits cannot deadlock. Waiting stops when the command's context is done,
+// and the time spent waiting is reported in RunResult.Queued and the
+// context's Stats.
+//
+// Limits are shared by everything using the returned middleware, so build
+// the executor chain once and share it between stages.
+func Throttle(limits ...Limit) Middleware {
+	gates := make([]*gate, len(limits))
+	for i, limit := range limits {
+		gates[i] = newGate(limit)
+	}
+	return func(next CommandExecutor) CommandExecutor {
+		return &interceptor{next: next, run: func(ctx context.Context, cmd Cmd) RunResult {
+			start := time.Now()
+			var held []*gate
+			release := func() {
+				for _, g := range held {
+					g.release()
+				}
+			}
+			for _, g := range gates {
+				if !g.limit.Match(cmd) {
+					continue
+				}
+				if err := g.acquire(ctx); err != nil {
+					release()
+					queued := time.Since(start)
+					StatsFromContext(ctx).addQueued(queued)
+					err = fmt.Errorf("waiting for limit %s: %w", g.limit.Name, err)
+					return RunResult{Error: err, Command: commandLine(next, cmd), ExitCode: -1, Elevated: cmd.Sudo, Queued: queued}
+				}
+				held = append(held, g)
+			}
+			defer release()
+
+			queued := time.Since(start)
+			StatsFromContext(ctx).addQueued(queued)
+			result := next.RunContext(ctx, cmd)
+			result.Queued += queued
+			return result
+		}}
+	}
+}
+
+// gate enforces one Limit
+type gate struct {
+	limit Limit
+	slots chan struct{}
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newGate(limit Limit) *gate {
+	g := &gate{limit: limit}
+	if limit.Max > 0 {
+		g.slots = make(chan struct{}, limit.Max)
+	}
+	return g
+}
+
+// acquire waits for a free slot and for the rate limit, or until ctx is done
+func (g *gate) acquire(ctx context.Context) error {
+	if g.slots != nil {
+		select {
+		case g.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if g.limit.Interval <= 0 {
+		return nil
+	}
+
+	// Reserve the next start time, then wait for it
+	g.mu.Lock()
+	now := time.Now()
+	at := g.next
+	if at.Before(now) {
+		at = now
+	}
+	g.next = at.Add(g.limit.Interval)
+	g.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		g.release()
+		return ctx.Err()
+	}
+}
+
+func (g *gate) release() {
+	if g.slots != nil {
+		<-g.slots
+	}
+}
@@ -0,0 +1,109 @@
+package exec
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowExecutor runs every command for d and records the most commands
+// running at once per program
+func slowExecutor(d time.Duration) (CommandExecutor, func(name string) int32) {
+	var mu sync.Mutex
+	running := map[string]int32{}
+	peak := map[string]int32{}
+	executor := &interceptor{run: func(ctx context.Context, cmd Cmd) RunResult {
+		mu.Lock()
+		running[cmd.Name]++
+		peak[cmd.Name] = max(peak[cmd.Name], running[cmd.Name])
+		mu.Unlock()
+
+		time.Sleep(d)
+
+		mu.Lock()
+		running[cmd.Name]--
+		mu.Unlock()
+		return RunResult{Success: true}
+	}}
+	return executor, func(name string) int32 {
+		mu.Lock()
+		defer mu.Unlock()
+		return peak[name]
+	}
+}
+
+func TestThrottle_MaxConcurrent(t *testing.T) {
+	base, peak := slowExecutor(20 * time.Millisecond)
+	executor := Chain(base, Throttle(MaxConcurrent(2, "git"), MaxConcurrent(1, "pacman")))
+
+	var wg sync.WaitGroup
+	var queued atomic.Int64
+	for range 6 {
+		for _, name := range []string{"git", "pacman", "stow"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result := executor.Run(name)
+				assert.True(t, result.Success)
+				queued.Add(int64(result.Queued))
+			}()
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), peak("git"))
+	assert.Equal(t, int32(1), peak("pacman"))
+	assert.Equal(t, int32(6), peak("stow"))
+	assert.Greater(t, time.Duration(queued.Load()), 20*time.Millisecond)
+}
+
+func TestThrottle_Interval(t *testing.T) {
+	base, _ := slowExecutor(0)
+	executor := Chain(base, Throttle(Limit{Name: "github", Match: MatchGlob("git", "clone https://github.com/*"), Interval: 20 * time.Millisecond}))
+	ctx, stats := WithStats(context.Background())
+
+	start := time.Now()
+	for range 3 {
+		executor.RunContext(ctx, Cmd{Name: "git", Args: []string{"clone", "https://github.com/x/y"}})
+	}
+	executor.RunContext(ctx, Cmd{Name: "git", Args: []string{"clone", "https://gitlab.com/x/y"}})
+
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+	assert.GreaterOrEqual(t, stats.Queued(), 40*time.Millisecond)
+}
+
+func TestThrottle_Cancel(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	base := &interceptor{run: func(ctx context.Context, cmd Cmd) RunResult {
+		close(started)
+		<-release
+		return RunResult{Success: true}
+	}}
+	executor := Chain(base, Throttle(MaxConcurrent(1, "git")))
+
+	go executor.Run("git", "clone", "a")
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ctx, stats := WithStats(ctx)
+	result := executor.RunContext(ctx, Cmd{Name: "git", Args: []string{"clone", "b"}})
+	close(release)
+
+	require.ErrorIs(t, result.Error, context.DeadlineExceeded)
+	assert.ErrorContains(t, result.Error, "waiting for limit git")
+	assert.Equal(t, -1, result.ExitCode)
+	assert.Equal(t, result.Queued, stats.Queued())
+	assert.Positive(t, stats.Queued())
+}
+
+func TestStats_Nil(t *testing.T) {
+	stats := StatsFromContext(context.Background())
+	assert.Nil(t, stats)
+	assert.Zero(t, stats.Queued())
+}
@@ -3,8 +3,12 @@ package logger
 import (
 	"log/slog"
 	"os"
+
+	"github.com/cwood/dotgraph/redact"
 )
 
+// Log is the global logger. Secrets registered with the redact package
+// are masked in everything it writes.
 var Log *slog.Logger
 
 func init() {
@@ -12,9 +16,9 @@ func init() {
 	opts := &slog.HandlerOptions{
 		Level: slog.LevelInfo,
 	}
-	
+
 	handler := slog.NewTextHandler(os.Stdout, opts)
-	Log = slog.New(handler)
+	Log = slog.New(redact.NewHandler(handler, nil))
 }
 
 // SetVerbose enables debug level logging
@@ -25,9 +29,9 @@ func SetVerbose(verbose bool) {
 	if !verbose {
 		opts.Level = slog.LevelInfo
 	}
-	
+
 	handler := slog.NewTextHandler(os.Stdout, opts)
-	Log = slog.New(handler)
+	Log = slog.New(redact.NewHandler(handler, nil))
 }
 
 // Info logs an info message
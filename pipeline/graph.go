@@ -4,16 +4,25 @@ import (
 	"context"
 	"fmt"
 	"runtime"
-	"sync"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/cwood/dotgraph/exec"
 	"github.com/cwood/dotgraph/logger"
 )
 
 // Graph represents a dependency graph of stages.
 // The type parameter T is the application-specific config type.
 type Graph[T any] struct {
-	stages   map[string]*GraphStage[T]
-	platform string
+	stages      map[string]*GraphStage[T]
+	platform    string
+	registry    *Registry[T]
+	parallelism int
+	policy      SchedulePolicy
+	cloneConfig func(T) T
+	history     *History
 }
 
 // GraphStage represents a stage in the dependency graph.
@@ -26,8 +35,9 @@ type GraphStage[T any] struct {
 	requires     []string
 	unless       []func(*Request[T]) bool
 	optional     bool
-	executed     bool
-	mu           sync.Mutex
+	weight       time.Duration // Explicit estimate set with Weight
+	estimate     time.Duration // Estimate learned from previous reports
+	env          map[string]string
 }
 
 // NewGraph creates a new dependency graph
@@ -38,6 +48,32 @@ func NewGraph[T any]() *Graph[T] {
 	}
 }
 
+// Registry returns the action kinds available to AddAction, creating a
+// registry with the built-in kinds on first use
+func (g *Graph[T]) Registry() *Registry[T] {
+	if g.registry == nil {
+		g.registry = NewRegistry[T]()
+	}
+	return g.registry
+}
+
+// UseRegistry sets the registry used by AddAction, so kinds can be shared
+// between graphs
+func (g *Graph[T]) UseRegistry(r *Registry[T]) *Graph[T] {
+	g.registry = r
+	return g
+}
+
+// AddAction adds a stage built from a registered action kind. The params are
+// validated against the kind's schema before the stage is added.
+func (g *Graph[T]) AddAction(name, kind string, params Params) (*GraphStage[T], error) {
+	run, err := g.Registry().Build(kind, params)
+	if err != nil {
+		return nil, fmt.Errorf("stage %s: %w", name, err)
+	}
+	return g.AddStage(name, run), nil
+}
+
 // AddStage adds a stage to the graph
 func (g *Graph[T]) AddStage(name string, run StageHandler[T]) *GraphStage[T] {
 	stage := &GraphStage[T]{
@@ -91,70 +127,92 @@ func (mb *MergeBuilder[T]) AddStage(name string, run StageHandler[T]) *GraphStag
 
 // Execute runs the graph, respecting dependencies
 func (g *Graph[T]) Execute(ctx context.Context, req *Request[T]) error {
+	_, err := g.Run(ctx, req)
+	return err
+}
+
+// Run executes the graph like Execute and returns a report of every stage.
+// Stages start as soon as their dependencies have finished, up to the
+// configured parallelism. Dependents of a failed stage are skipped unless
+// the failed stage is optional. The returned error is the first failure.
+func (g *Graph[T]) Run(ctx context.Context, req *Request[T]) (*Report, error) {
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+
 	logger.Info("Executing bootstrap graph", "stages", len(g.stages))
 
-	// Find root stages (no dependencies)
-	roots := make([]*GraphStage[T], 0)
-	for _, stage := range g.stages {
-		if len(stage.dependencies) == 0 {
-			roots = append(roots, stage)
+	run := newGraphRun(g)
+	report, err := run.execute(ctx, req)
+	if g.history != nil && report != nil {
+		// A run that could not be recorded has still run
+		if appendErr := g.history.Append(report); appendErr != nil {
+			logger.Warn("Failed to record run in history", "path", g.history.Path, "error", appendErr)
 		}
 	}
+	if err != nil {
+		return report, err
+	}
 
-	// Execute from roots
-	var wg sync.WaitGroup
-	errChan := make(chan error, len(g.stages))
+	logger.Success("Bootstrap graph completed successfully")
+	return report, nil
+}
 
-	for _, root := range roots {
-		wg.Add(1)
-		go func(s *GraphStage[T]) {
-			defer wg.Done()
-			if err := g.executeStage(ctx, req, s); err != nil {
-				errChan <- err
-			}
-		}(root)
-	}
+// SetParallelism limits how many stages run at the same time.
+// Zero or less means no limit.
+func (g *Graph[T]) SetParallelism(n int) *Graph[T] {
+	g.parallelism = n
+	return g
+}
 
-	wg.Wait()
-	close(errChan)
+// SetPolicy sets how the next stage is chosen when more stages are ready
+// than the parallelism limit allows
+func (g *Graph[T]) SetPolicy(policy SchedulePolicy) *Graph[T] {
+	g.policy = policy
+	return g
+}
 
-	// Check for errors
-	for err := range errChan {
-		if err != nil {
-			return err
-		}
-	}
+// CloneConfig sets a function used to give each stage its own copy of
+// Request.Config. Without it, stages share the same Config value, which
+// should then be treated as read-only.
+func (g *Graph[T]) CloneConfig(clone func(T) T) *Graph[T] {
+	g.cloneConfig = clone
+	return g
+}
 
-	logger.Success("Bootstrap graph completed successfully")
-	return nil
+// RecordTo appends the report of every run to h, so later runs can be
+// compared with it
+func (g *Graph[T]) RecordTo(h *History) *Graph[T] {
+	g.history = h
+	return g
 }
 
-// executeStage executes a stage and its dependents
-func (g *Graph[T]) executeStage(ctx context.Context, req *Request[T], stage *GraphStage[T]) error {
-	stage.mu.Lock()
-	if stage.executed {
-		stage.mu.Unlock()
-		return nil
-	}
-	stage.mu.Unlock()
+// runStage checks a stage's platform, conditions and requirements and runs
+// it with a request scoped to the stage
+func (g *Graph[T]) runStage(ctx context.Context, req *Request[T], stage *GraphStage[T]) *StageResult {
+	req = req.forStage(ctx, stage, g.cloneConfig)
+	result := &StageResult{Name: stage.name, Optional: stage.optional, Start: time.Now()}
+	defer func() {
+		result.Duration = time.Since(result.Start)
+		stats := exec.StatsFromContext(req.Context())
+		result.Queued = stats.Queued()
+		if stats.Commands() > 0 {
+			usage := stats.Usage()
+			result.Usage = &usage
+		}
+	}()
 
 	// Check platform
 	if stage.platform != "" && stage.platform != g.platform {
 		logger.Debug("Skipping stage", "stage", stage.name, "reason", "platform mismatch", "expected", stage.platform, "current", g.platform)
-		stage.mu.Lock()
-		stage.executed = true
-		stage.mu.Unlock()
-		return nil
+		return result.skip("platform mismatch")
 	}
 
 	// Check unless conditions
 	for _, condition := range stage.unless {
 		if condition(req) {
 			logger.Debug("Skipping stage", "stage", stage.name, "reason", "unless condition met")
-			stage.mu.Lock()
-			stage.executed = true
-			stage.mu.Unlock()
-			return nil
+			return result.skip("unless condition met")
 		}
 	}
 
@@ -164,12 +222,9 @@ func (g *Graph[T]) executeStage(ctx context.Context, req *Request[T], stage *Gra
 		if err != nil {
 			if stage.optional {
 				logger.Debug("Skipping stage", "stage", stage.name, "reason", "missing requirement", "command", cmd)
-				stage.mu.Lock()
-				stage.executed = true
-				stage.mu.Unlock()
-				return nil
+				return result.skip("missing requirement " + cmd)
 			}
-			return fmt.Errorf("stage %s requires command %s which is not available", stage.name, cmd)
+			return result.fail(fmt.Errorf("stage %s requires command %s which is not available", stage.name, cmd))
 		}
 	}
 
@@ -178,76 +233,86 @@ func (g *Graph[T]) executeStage(ctx context.Context, req *Request[T], stage *Gra
 	if err := stage.run(req); err != nil {
 		if stage.optional {
 			logger.Warn("Stage failed (optional)", "stage", stage.name, "error", err)
-		} else {
-			return fmt.Errorf("stage %s failed: %w", stage.name, err)
 		}
-	} else {
-		logger.Success(stage.name)
+		return result.fail(fmt.Errorf("stage %s failed: %w", stage.name, err))
 	}
 
-	stage.mu.Lock()
-	stage.executed = true
-	stage.mu.Unlock()
-
-	// Find and execute dependent stages
-	dependents := g.findDependents(stage)
-	if len(dependents) > 0 {
-		var wg sync.WaitGroup
-		errChan := make(chan error, len(dependents))
+	logger.Success(stage.name)
+	result.Status = StatusSucceeded
+	return result
+}
 
-		for _, dep := range dependents {
-			// Check if all dependencies are satisfied
-			if !g.allDependenciesMet(dep) {
-				continue
+// Validate checks that every dependency refers to a stage in the graph and
+// that the dependencies do not form a cycle
+func (g *Graph[T]) Validate() error {
+	for _, stage := range g.stages {
+		for _, dep := range stage.dependencies {
+			if g.stages[dep.name] != dep {
+				return fmt.Errorf("stage %s depends on %s which is not part of the graph", stage.name, dep.name)
 			}
-
-			wg.Add(1)
-			go func(s *GraphStage[T]) {
-				defer wg.Done()
-				if err := g.executeStage(ctx, req, s); err != nil {
-					errChan <- err
-				}
-			}(dep)
 		}
+	}
 
-		wg.Wait()
-		close(errChan)
-
-		for err := range errChan {
-			if err != nil {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*GraphStage[T]]int, len(g.stages))
+	var visit func(s *GraphStage[T], path []string) error
+	visit = func(s *GraphStage[T], path []string) error {
+		switch state[s] {
+		case visiting:
+			return &CycleError{Path: append(path, s.name)}
+		case visited:
+			return nil
+		}
+		state[s] = visiting
+		for _, dep := range s.dependencies {
+			if err := visit(dep, append(slices.Clone(path), s.name)); err != nil {
 				return err
 			}
 		}
+		state[s] = visited
+		return nil
+	}
+	for _, name := range g.stageNames() {
+		if err := visit(g.stages[name], nil); err != nil {
+			return err
+		}
 	}
-
 	return nil
 }
 
-// findDependents finds stages that depend on the given stage
-func (g *Graph[T]) findDependents(stage *GraphStage[T]) []*GraphStage[T] {
-	dependents := make([]*GraphStage[T], 0)
-	for _, s := range g.stages {
-		for _, dep := range s.dependencies {
-			if dep == stage {
-				dependents = append(dependents, s)
-				break
-			}
-		}
-	}
-	return dependents
+// CycleError is returned by Validate for dependencies that form a cycle
+type CycleError struct {
+	// Path lists the stages of the cycle, each depending on the next, and
+	// ends with the stage it started at
+	Path []string
 }
 
-// allDependenciesMet checks if all dependencies of a stage are executed
-func (g *Graph[T]) allDependenciesMet(stage *GraphStage[T]) bool {
-	for _, dep := range stage.dependencies {
-		dep.mu.Lock()
-		executed := dep.executed
-		dep.mu.Unlock()
-		if !executed {
-			return false
-		}
+func (e *CycleError) Error() string {
+	return "dependency cycle: " + strings.Join(e.Path, " -> ")
+}
+
+// stageNames returns the names of all stages in sorted order
+func (g *Graph[T]) stageNames() []string {
+	names := make([]string, 0, len(g.stages))
+	for name := range g.stages {
+		names = append(names, name)
 	}
-	return true
+	sort.Strings(names)
+	return names
+}
+
+// Stage returns the stage with the given name, or nil if there is none
+func (g *Graph[T]) Stage(name string) *GraphStage[T] {
+	return g.stages[name]
+}
+
+// Name returns the stage name
+func (s *GraphStage[T]) Name() string {
+	return s.name
 }
 
 // After adds dependencies to this stage
@@ -274,6 +339,32 @@ func (s *GraphStage[T]) Optional() *GraphStage[T] {
 	return s
 }
 
+// Env sets an environment variable override for the stage. It is visible
+// to the stage as req.Env.Vars[key] and does not affect other stages.
+func (s *GraphStage[T]) Env(key, value string) *GraphStage[T] {
+	if s.env == nil {
+		s.env = make(map[string]string)
+	}
+	s.env[key] = value
+	return s
+}
+
+// Weight sets the estimated duration of the stage, used by the critical
+// path scheduling policy. It takes precedence over learned estimates.
+func (s *GraphStage[T]) Weight(d time.Duration) *GraphStage[T] {
+	s.weight = d
+	return s
+}
+
+// EstimatedDuration returns the explicit weight, or the duration learned
+// from previous reports if no weight was set
+func (s *GraphStage[T]) EstimatedDuration() time.Duration {
+	if s.weight > 0 {
+		return s.weight
+	}
+	return s.estimate
+}
+
 // PlatformBuilder helps build platform-specific stages
 type PlatformBuilder[T any] struct {
 	graph    *Graph[T]
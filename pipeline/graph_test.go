@@ -0,0 +1,323 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cwood/dotgraph/exec"
+	"github.com/cwood/dotgraph/exec/fake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder collects the order in which stages run
+type recorder struct {
+	mu    sync.Mutex
+	order []string
+}
+
+func (r *recorder) stage(name string) StageHandler[any] {
+	return func(*Request[any]) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.order = append(r.order, name)
+		return nil
+	}
+}
+
+func TestGraph_Run_RespectsDependencies(t *testing.T) {
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+
+	rec := &recorder{}
+	graph := NewGraph[any]()
+	a := graph.AddStage("a", rec.stage("a"))
+	b := graph.AddStage("b", rec.stage("b")).After(a)
+	graph.AddStage("c", rec.stage("c")).After(a, b)
+
+	report, err := graph.Run(context.Background(), req)
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, rec.order)
+	require.Len(t, report.Stages, 3)
+	assert.Equal(t, StatusSucceeded, report.Stage("c").Status)
+}
+
+func TestGraph_Run_SkippedStageReleasesDependents(t *testing.T) {
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+
+	rec := &recorder{}
+	graph := NewGraph[any]()
+	graph.platform = "linux"
+	mac := graph.AddPlatform("darwin").AddStage("brew", rec.stage("brew"))
+	graph.AddStage("after", rec.stage("after")).After(mac)
+
+	report, err := graph.Run(context.Background(), req)
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"after"}, rec.order)
+	assert.Equal(t, StatusSkipped, report.Stage("brew").Status)
+	assert.Equal(t, "platform mismatch", report.Stage("brew").Reason)
+}
+
+func TestGraph_Run_FailureSkipsDependents(t *testing.T) {
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+
+	rec := &recorder{}
+	graph := NewGraph[any]()
+	fail := graph.AddStage("fail", func(*Request[any]) error { return errors.New("boom") })
+	child := graph.AddStage("child", rec.stage("child")).After(fail)
+	graph.AddStage("grandchild", rec.stage("grandchild")).After(child)
+	graph.AddStage("independent", rec.stage("independent"))
+
+	report, err := graph.Run(context.Background(), req)
+
+	require.EqualError(t, err, "stage fail failed: boom")
+	assert.Equal(t, []string{"independent"}, rec.order)
+	assert.Equal(t, StatusFailed, report.Stage("fail").Status)
+	assert.Equal(t, "dependency fail failed", report.Stage("child").Reason)
+	assert.Equal(t, "dependency child failed", report.Stage("grandchild").Reason)
+}
+
+func TestGraph_Run_OptionalFailureContinues(t *testing.T) {
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+
+	rec := &recorder{}
+	graph := NewGraph[any]()
+	fail := graph.AddStage("fail", func(*Request[any]) error { return errors.New("boom") }).Optional()
+	graph.AddStage("child", rec.stage("child")).After(fail)
+
+	report, err := graph.Run(context.Background(), req)
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"child"}, rec.order)
+	assert.Equal(t, StatusFailed, report.Stage("fail").Status)
+	assert.False(t, report.Stage("fail").Fatal())
+}
+
+func TestGraph_Run_Parallelism(t *testing.T) {
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+
+	var running, peak atomic.Int32
+	handler := func(*Request[any]) error {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		running.Add(-1)
+		return nil
+	}
+
+	graph := NewGraph[any]().SetParallelism(2)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		graph.AddStage(name, handler)
+	}
+
+	_, err := graph.Run(context.Background(), req)
+
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), peak.Load())
+}
+
+func TestGraph_Run_CriticalPathPolicy(t *testing.T) {
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+
+	rec := &recorder{}
+	graph := NewGraph[any]().SetParallelism(1).SetPolicy(ScheduleCriticalPath)
+	graph.AddStage("a-quick", rec.stage("a-quick")).Weight(time.Second)
+	aur := graph.AddStage("b-aur", rec.stage("b-aur")).Weight(time.Minute)
+	graph.AddStage("c-config", rec.stage("c-config")).Weight(time.Second)
+	graph.AddStage("d-after-aur", rec.stage("d-after-aur")).After(aur).Weight(time.Second)
+
+	_, err := graph.Run(context.Background(), req)
+
+	require.NoError(t, err)
+	assert.Equal(t, "b-aur", rec.order[0])
+}
+
+func TestGraph_Run_Cancelled(t *testing.T) {
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	graph := NewGraph[any]()
+	first := graph.AddStage("first", func(*Request[any]) error {
+		cancel()
+		return nil
+	})
+	graph.AddStage("second", func(*Request[any]) error { return nil }).After(first)
+
+	report, err := graph.Run(ctx, req)
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, "cancelled", report.Stage("second").Reason)
+}
+
+func TestGraph_Validate_Cycle(t *testing.T) {
+	graph := NewGraph[any]()
+	a := graph.AddStage("a", nil)
+	b := graph.AddStage("b", nil).After(a)
+	a.After(b)
+
+	assert.ErrorContains(t, graph.Validate(), "dependency cycle")
+}
+
+func TestGraph_CriticalPath(t *testing.T) {
+	graph := NewGraph[any]()
+	a := graph.AddStage("a", nil)
+	b := graph.AddStage("b", nil).After(a)
+	c := graph.AddStage("c", nil).After(a)
+	graph.AddStage("d", nil).After(b, c)
+
+	start := time.Now()
+	report := &Report{Stages: []*StageResult{
+		{Name: "a", Start: start, Duration: time.Second},
+		{Name: "b", Start: start.Add(time.Second), Duration: time.Second},
+		{Name: "c", Start: start.Add(time.Second), Duration: 5 * time.Second},
+		{Name: "d", Start: start.Add(6 * time.Second), Duration: time.Second},
+	}}
+
+	assert.Equal(t, []string{"a", "c", "d"}, graph.CriticalPath(report))
+}
+
+func TestGraph_CriticalPath_Estimated(t *testing.T) {
+	graph := NewGraph[any]()
+	a := graph.AddStage("a", nil)
+	graph.AddStage("b", nil).After(a).Weight(time.Minute)
+	graph.AddStage("c", nil).After(a)
+
+	report := &Report{Stages: []*StageResult{
+		{Name: "c", Status: StatusSucceeded, Duration: 2 * time.Minute},
+	}}
+	graph.LearnWeights(report)
+
+	assert.Equal(t, 2*time.Minute, graph.Stage("c").EstimatedDuration())
+	assert.Equal(t, []string{"a", "c"}, graph.CriticalPath(nil))
+}
+
+func TestGraph_Run_ScopedRequest(t *testing.T) {
+	req, tmpDir := newTestRequest[*[]string](t, &[]string{"shared"})
+	defer os.RemoveAll(tmpDir)
+	req.Env.Vars = map[string]string{"EDITOR": "vim"}
+
+	var mu sync.Mutex
+	seen := make(map[string]*Request[*[]string])
+	record := func(req *Request[*[]string]) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[req.Stage] = req
+	}
+
+	graph := NewGraph[*[]string]().CloneConfig(func(c *[]string) *[]string {
+		clone := append([]string(nil), *c...)
+		return &clone
+	})
+	writer := graph.AddStage("writer", func(req *Request[*[]string]) error {
+		req.Options.DryRun = true
+		req.Env.WorkDir = "/elsewhere"
+		*req.Config = append(*req.Config, "writer")
+		record(req)
+		return nil
+	}).Env("EDITOR", "nvim")
+	graph.AddStage("reader", func(req *Request[*[]string]) error {
+		record(req)
+		return nil
+	}).After(writer)
+
+	_, err := graph.Run(context.Background(), req)
+	require.NoError(t, err)
+
+	reader := seen["reader"]
+	require.NotNil(t, reader)
+	assert.Equal(t, "reader", reader.Stage)
+	assert.NotNil(t, reader.Log)
+	assert.False(t, reader.Options.DryRun)
+	assert.Equal(t, tmpDir, reader.Env.WorkDir)
+	assert.Equal(t, "vim", reader.Env.Vars["EDITOR"])
+	assert.Equal(t, []string{"shared"}, *reader.Config)
+
+	assert.Equal(t, "nvim", seen["writer"].Env.Vars["EDITOR"])
+	assert.Equal(t, []string{"shared"}, *req.Config)
+	assert.Equal(t, "vim", req.Env.Vars["EDITOR"])
+}
+
+func TestGraph_Run_QueuedTime(t *testing.T) {
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+
+	f := fake.New()
+	f.On("git", "clone *").Do(func(ctx context.Context, cmd exec.Cmd) exec.RunResult {
+		time.Sleep(30 * time.Millisecond)
+		return exec.RunResult{Success: true}
+	})
+	req.Options.Limits = []exec.Limit{exec.MaxConcurrent(1, "git")}
+	req.Services.Executor = exec.Chain(f, req.Options.Middlewares()...)
+
+	graph := NewGraph[any]()
+	for _, name := range []string{"nvim", "zsh"} {
+		graph.AddStage(name, func(req *Request[any]) error {
+			return resultError("git", req.Services.Executor.RunContext(req.Context(), exec.Cmd{Name: "git", Args: []string{"clone", name}}))
+		})
+	}
+
+	report, err := graph.Run(context.Background(), req)
+	require.NoError(t, err)
+
+	first, second := report.Stages[0], report.Stages[1]
+	assert.Less(t, first.Queued, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, second.Queued, 20*time.Millisecond)
+	assert.Greater(t, second.Duration, second.Queued)
+}
+
+func TestOptions_Middlewares_DryRunSkipsLimits(t *testing.T) {
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+
+	// A second git command would wait an hour if the limit applied
+	req.Options.DryRun = true
+	req.Options.Limits = []exec.Limit{{Name: "git", Match: exec.MatchNames("git"), Interval: time.Hour}}
+	req.Services.Executor = exec.Chain(fake.New(), req.Options.Middlewares()...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	first := req.Services.Executor.RunContext(ctx, exec.Cmd{Name: "git", Args: []string{"pull"}})
+	second := req.Services.Executor.RunContext(ctx, exec.Cmd{Name: "git", Args: []string{"pull"}})
+
+	assert.True(t, first.Success, first.Error)
+	assert.True(t, second.Success, second.Error)
+	assert.Zero(t, second.Queued)
+}
+
+func TestGraph_Run_Usage(t *testing.T) {
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+	req.Services.Executor = &exec.RealExecutor{LogDir: tmpDir}
+
+	graph := NewGraph[any]()
+	graph.AddStage("busy", runCommand[any](exec.Cmd{Name: "sh", Args: []string{"-c", "i=0; while [ $i -lt 50000 ]; do i=$((i+1)); done"}}))
+	graph.AddStage("idle", func(*Request[any]) error { return nil })
+
+	report, err := graph.Run(context.Background(), req)
+	require.NoError(t, err)
+
+	busy := report.Stage("busy").Usage
+	require.NotNil(t, busy)
+	assert.Positive(t, busy.CPUTime())
+	assert.Positive(t, busy.MaxRSS)
+	assert.Nil(t, report.Stage("idle").Usage)
+	assert.Equal(t, *busy, report.Usage())
+}
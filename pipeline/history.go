@@ -0,0 +1,197 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/cwood/dotgraph/exec"
+)
+
+// History is a local log of run reports, stored one JSON object per line so
+// runs can be appended without rewriting the file
+type History struct {
+	// Path is the history file
+	Path string
+}
+
+// NewHistory creates a History stored at path
+func NewHistory(path string) *History {
+	return &History{Path: path}
+}
+
+// DefaultHistoryPath returns history.jsonl in exec.StateDir
+func DefaultHistoryPath() string {
+	return filepath.Join(exec.StateDir(), "history.jsonl")
+}
+
+// Append adds a report to the end of the history
+func (h *History) Append(report *Report) error {
+	line, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.Path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(h.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Load returns every report in the history, oldest first.
+// A missing history file is not an error.
+func (h *History) Load() ([]*Report, error) {
+	f, err := os.Open(h.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reports := make([]*Report, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var report Report
+		if err := json.Unmarshal(scanner.Bytes(), &report); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", h.Path, lineNo, err)
+		}
+		reports = append(reports, &report)
+	}
+	return reports, scanner.Err()
+}
+
+// Last returns the n most recent reports, oldest first. A negative n
+// returns none.
+func (h *History) Last(n int) ([]*Report, error) {
+	reports, err := h.Load()
+	if err != nil {
+		return nil, err
+	}
+	n = max(0, min(n, len(reports)))
+	return reports[len(reports)-n:], nil
+}
+
+// StageDelta is the change of one stage between two runs
+type StageDelta struct {
+	Name         string
+	Before       time.Duration
+	After        time.Duration
+	Delta        time.Duration
+	BeforeStatus StageStatus
+	AfterStatus  StageStatus
+}
+
+// Comparison describes how a run differs from an earlier one
+type Comparison struct {
+	// Duration is the change in total runtime
+	Duration time.Duration
+
+	// Stages holds the stages present in both runs, largest slowdown first
+	Stages []StageDelta
+
+	// NewlyFailing lists stages that failed in the later run but not in the earlier one
+	NewlyFailing []string
+
+	// Fixed lists stages that failed in the earlier run but not in the later one
+	Fixed []string
+
+	// Added lists stages only present in the later run
+	Added []string
+
+	// Removed lists stages only present in the earlier run
+	Removed []string
+}
+
+// Compare compares a run against an earlier one
+func Compare(before, after *Report) *Comparison {
+	c := &Comparison{Duration: after.Duration - before.Duration}
+
+	for _, a := range after.Stages {
+		b := before.Stage(a.Name)
+		if b == nil {
+			c.Added = append(c.Added, a.Name)
+			if a.Status == StatusFailed {
+				c.NewlyFailing = append(c.NewlyFailing, a.Name)
+			}
+			continue
+		}
+		c.Stages = append(c.Stages, StageDelta{
+			Name:         a.Name,
+			Before:       b.Duration,
+			After:        a.Duration,
+			Delta:        a.Duration - b.Duration,
+			BeforeStatus: b.Status,
+			AfterStatus:  a.Status,
+		})
+		switch {
+		case a.Status == StatusFailed && b.Status != StatusFailed:
+			c.NewlyFailing = append(c.NewlyFailing, a.Name)
+		case a.Status != StatusFailed && b.Status == StatusFailed:
+			c.Fixed = append(c.Fixed, a.Name)
+		}
+	}
+	for _, b := range before.Stages {
+		if after.Stage(b.Name) == nil {
+			c.Removed = append(c.Removed, b.Name)
+		}
+	}
+
+	sort.SliceStable(c.Stages, func(i, j int) bool { return c.Stages[i].Delta > c.Stages[j].Delta })
+	sort.Strings(c.NewlyFailing)
+	sort.Strings(c.Fixed)
+	sort.Strings(c.Added)
+	sort.Strings(c.Removed)
+	return c
+}
+
+// Flakiness scores each stage by how often its outcome flips between
+// consecutive runs in which it ran: 0 means it always had the same outcome,
+// 1 means it alternated between success and failure every run. Skipped runs
+// are ignored. Reports must be ordered oldest first, as returned by Load.
+func Flakiness(reports []*Report) map[string]float64 {
+	last := make(map[string]StageStatus)
+	runs := make(map[string]int)
+	flips := make(map[string]int)
+
+	for _, report := range reports {
+		for _, result := range report.Stages {
+			if result.Status == StatusSkipped {
+				continue
+			}
+			if prev, ok := last[result.Name]; ok && prev != result.Status {
+				flips[result.Name]++
+			}
+			last[result.Name] = result.Status
+			runs[result.Name]++
+		}
+	}
+
+	scores := make(map[string]float64, len(runs))
+	for name, n := range runs {
+		if n < 2 {
+			scores[name] = 0
+			continue
+		}
+		scores[name] = float64(flips[name]) / float64(n-1)
+	}
+	return scores
+}
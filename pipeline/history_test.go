@@ -0,0 +1,123 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testReport(duration time.Duration, stages ...*StageResult) *Report {
+	return &Report{Start: time.Now().Truncate(time.Second), Duration: duration, Stages: stages}
+}
+
+func TestHistory_AppendAndLoad(t *testing.T) {
+	history := NewHistory(filepath.Join(t.TempDir(), "state", "history.jsonl"))
+
+	reports, err := history.Load()
+	require.NoError(t, err)
+	assert.Empty(t, reports)
+
+	failed := (&StageResult{Name: "b", Duration: time.Second}).fail(errors.New("boom"))
+	require.NoError(t, history.Append(testReport(time.Minute, &StageResult{Name: "a", Status: StatusSucceeded, Duration: 2 * time.Second})))
+	require.NoError(t, history.Append(testReport(2*time.Minute, failed)))
+
+	reports, err = history.Load()
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+	assert.Equal(t, time.Minute, reports[0].Duration)
+	assert.Equal(t, 2*time.Second, reports[0].Stage("a").Duration)
+	assert.Equal(t, StatusFailed, reports[1].Stage("b").Status)
+	assert.Equal(t, "boom", reports[1].Stage("b").Error)
+
+	last, err := history.Last(1)
+	require.NoError(t, err)
+	require.Len(t, last, 1)
+	assert.Equal(t, 2*time.Minute, last[0].Duration)
+
+	last, err = history.Last(5)
+	require.NoError(t, err)
+	assert.Len(t, last, 2)
+
+	last, err = history.Last(-1)
+	require.NoError(t, err)
+	assert.Empty(t, last)
+}
+
+func TestGraph_RecordTo(t *testing.T) {
+	history := NewHistory(filepath.Join(t.TempDir(), "history.jsonl"))
+	graph := NewGraph[any]().RecordTo(history)
+	graph.AddStage("ok", func(*Request[any]) error { return nil })
+	graph.AddStage("broken", func(*Request[any]) error { return errors.New("boom") })
+
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+	_, err := graph.Run(context.Background(), req)
+	require.Error(t, err)
+
+	reports, err := history.Load()
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	assert.Equal(t, StatusSucceeded, reports[0].Stage("ok").Status)
+	assert.Equal(t, StatusFailed, reports[0].Stage("broken").Status)
+}
+
+func TestHistory_Load_Malformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	require.NoError(t, os.WriteFile(path, []byte("{}\nnot json\n"), 0644))
+
+	_, err := NewHistory(path).Load()
+
+	assert.ErrorContains(t, err, "history.jsonl:2:")
+}
+
+func TestCompare(t *testing.T) {
+	before := testReport(10*time.Second,
+		&StageResult{Name: "a", Status: StatusSucceeded, Duration: 2 * time.Second},
+		&StageResult{Name: "b", Status: StatusSucceeded, Duration: 3 * time.Second},
+		&StageResult{Name: "c", Status: StatusFailed, Duration: time.Second},
+		&StageResult{Name: "old", Status: StatusSucceeded},
+	)
+	after := testReport(15*time.Second,
+		&StageResult{Name: "a", Status: StatusSucceeded, Duration: time.Second},
+		&StageResult{Name: "b", Status: StatusFailed, Duration: 8 * time.Second},
+		&StageResult{Name: "c", Status: StatusSucceeded, Duration: time.Second},
+		&StageResult{Name: "new", Status: StatusSucceeded},
+	)
+
+	c := Compare(before, after)
+
+	assert.Equal(t, 5*time.Second, c.Duration)
+	require.Len(t, c.Stages, 3)
+	assert.Equal(t, "b", c.Stages[0].Name)
+	assert.Equal(t, 5*time.Second, c.Stages[0].Delta)
+	assert.Equal(t, -time.Second, c.Stages[2].Delta)
+	assert.Equal(t, []string{"b"}, c.NewlyFailing)
+	assert.Equal(t, []string{"c"}, c.Fixed)
+	assert.Equal(t, []string{"new"}, c.Added)
+	assert.Equal(t, []string{"old"}, c.Removed)
+}
+
+func TestFlakiness(t *testing.T) {
+	ok := func(name string) *StageResult { return &StageResult{Name: name, Status: StatusSucceeded} }
+	bad := func(name string) *StageResult { return &StageResult{Name: name, Status: StatusFailed} }
+	skip := func(name string) *StageResult { return &StageResult{Name: name, Status: StatusSkipped} }
+
+	reports := []*Report{
+		testReport(0, ok("stable"), ok("flaky"), ok("once")),
+		testReport(0, ok("stable"), bad("flaky"), skip("once")),
+		testReport(0, ok("stable"), ok("flaky")),
+		testReport(0, ok("stable"), bad("flaky")),
+	}
+
+	scores := Flakiness(reports)
+
+	assert.Equal(t, 0.0, scores["stable"])
+	assert.Equal(t, 1.0, scores["flaky"])
+	assert.Equal(t, 0.0, scores["once"])
+}
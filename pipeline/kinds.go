@@ -0,0 +1,136 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cwood/dotgraph/exec"
+	"github.com/cwood/dotgraph/logger"
+	"github.com/cwood/dotgraph/pkg"
+)
+
+// builtinKinds returns the action kinds every registry starts with
+func builtinKinds[T any]() []Kind[T] {
+	return []Kind[T]{
+		{
+			Name: "pkg.install",
+			Doc:  "Install packages with the platform package manager",
+			Params: []Param{
+				{Name: "packages", Type: StringListParam, Required: true, Doc: "Packages to install"},
+			},
+			Build: buildPkgInstall[T],
+		},
+		{
+			Name: "git.clone",
+			Doc:  "Clone a git repository unless the destination already exists",
+			Params: []Param{
+				{Name: "url", Type: StringParam, Required: true, Doc: "Repository URL"},
+				{Name: "dest", Type: StringParam, Required: true, Doc: "Destination path (~ and $HOME expand to WorkDir)"},
+				{Name: "branch", Type: StringParam, Doc: "Branch to check out"},
+			},
+			Build: buildGitClone[T],
+		},
+		{
+			Name: "symlink",
+			Doc:  "Create a symbolic link",
+			Params: []Param{
+				{Name: "src", Type: StringParam, Required: true, Doc: "Link target (~ and $HOME expand to WorkDir)"},
+				{Name: "dest", Type: StringParam, Required: true, Doc: "Link location (~ and $HOME expand to WorkDir)"},
+				{Name: "force", Type: BoolParam, Default: false, Doc: "Replace an existing file at dest"},
+			},
+			Build: buildSymlink[T],
+		},
+	}
+}
+
+func buildPkgInstall[T any](params Params) (StageHandler[T], error) {
+	packages := params.Strings("packages")
+	if len(packages) == 0 {
+		return nil, fmt.Errorf("packages must not be empty")
+	}
+	return func(req *Request[T]) error {
+		return pkg.InstallContext(req.Context(), req.Services.Installer, packages...)
+	}, nil
+}
+
+func buildGitClone[T any](params Params) (StageHandler[T], error) {
+	url, dest, branch := params.String("url"), params.String("dest"), params.String("branch")
+	return func(req *Request[T]) error {
+		path := expandPathWithWorkDir(dest, req.Env.WorkDir)
+		if _, err := os.Stat(path); err == nil {
+			logger.Debug("Clone destination exists", "path", path)
+			return nil
+		}
+
+		args := []string{"clone"}
+		if branch != "" {
+			args = append(args, "--branch", branch)
+		}
+		args = append(args, url, path)
+
+		cmd := exec.Cmd{Name: "git", Args: args, Env: req.Env.Environ()}
+		return resultError("git", req.Services.Executor.RunContext(req.Context(), cmd))
+	}, nil
+}
+
+func buildSymlink[T any](params Params) (StageHandler[T], error) {
+	src, dest, force := params.String("src"), params.String("dest"), params.Bool("force")
+	return func(req *Request[T]) error {
+		target := expandPathWithWorkDir(src, req.Env.WorkDir)
+		link := expandPathWithWorkDir(dest, req.Env.WorkDir)
+
+		if current, err := os.Readlink(link); err == nil && current == target {
+			return nil
+		}
+		if req.Options.DryRun {
+			logger.Info("Dry run: would create symlink", "link", link, "target", target)
+			return nil
+		}
+
+		if _, err := os.Lstat(link); err == nil {
+			if !force {
+				return fmt.Errorf("%s already exists", link)
+			}
+			if err := os.RemoveAll(link); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+			return err
+		}
+		return os.Symlink(target, link)
+	}, nil
+}
+
+// runCommand returns a stage handler that runs cmd through the request's
+// executor with the stage's environment variables
+func runCommand[T any](cmd exec.Cmd) StageHandler[T] {
+	return func(req *Request[T]) error {
+		cmd := cmd
+		cmd.Env = req.Env.Environ()
+		return resultError(cmd.Name, req.Services.Executor.RunContext(req.Context(), cmd))
+	}
+}
+
+// runScript returns a stage handler that runs script with exec.RunScriptContext
+// through the request's executor with the stage's environment variables
+func runScript[T any](script exec.Script) StageHandler[T] {
+	return func(req *Request[T]) error {
+		script := script
+		script.Env = req.Env.Environ()
+		return resultError("script", exec.RunScriptContext(req.Context(), req.Services.Executor, script))
+	}
+}
+
+// resultError converts a failed RunResult into an error that points at the
+// failure log
+func resultError(name string, result exec.RunResult) error {
+	if result.Success {
+		return nil
+	}
+	if result.LogFile != "" {
+		return fmt.Errorf("%s: %w (log: %s)", name, result.Error, result.LogFile)
+	}
+	return fmt.Errorf("%s: %w", name, result.Error)
+}
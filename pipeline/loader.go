@@ -0,0 +1,527 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/cwood/dotgraph/exec"
+	"gopkg.in/yaml.v3"
+)
+
+// Loader builds a Graph from a YAML definition so stages can be added
+// without recompiling.
+//
+// A definition is a list of stages:
+//
+//	stages:
+//	  - name: install-git
+//	    platform: linux
+//	    unless:
+//	      - command_exists: git
+//	    action:
+//	      shell: pacman -S --noconfirm git
+//	      sudo: true
+//	  - name: clone-dotfiles
+//	    after: [install-git]
+//	    requires: [git]
+//	    when:
+//	      - env_set: DOTFILES_REPO
+//	    optional: true
+//	    action:
+//	      handler: clone-dotfiles
+//
+// Conditions under unless and when are the built-in ones: command_exists,
+// file_exists, env_set, is_mac, is_linux, not, and, or. A stage is skipped if
+// any unless condition is true or any when condition is false.
+//
+// An action either references a Go handler registered in Handlers, uses an
+// action kind from Registry with its params, runs a shell snippet with
+// "sh -c", runs a multi-line script with bash in strict mode (see
+// exec.RunScript), or runs a command given as an argument list. Shell
+// snippets, scripts and commands are run through Services.Executor, as root
+// if sudo is true.
+//
+//	action:
+//	  command: [pacman, -S, --noconfirm, git]
+//	  sudo: true
+//
+//	action:
+//	  script: |
+//	    mkdir -p ~/.config
+//	    curl -fsSL https://example.com/install.sh | sh
+//
+//	action:
+//	  kind: pkg.install
+//	  params:
+//	    packages: [git, tmux]
+type Loader[T any] struct {
+	// Handlers maps names referenced by action.handler to stage handlers
+	Handlers map[string]StageHandler[T]
+
+	// Registry provides the kinds referenced by action.kind. If nil, a
+	// registry with the built-in kinds is used.
+	Registry *Registry[T]
+}
+
+// knownPlatforms are the GOOS values a stage's platform may name
+var knownPlatforms = []string{
+	"aix", "android", "darwin", "dragonfly", "freebsd", "illumos", "ios", "js",
+	"linux", "netbsd", "openbsd", "plan9", "solaris", "wasip1", "windows",
+}
+
+// LoadError describes a problem at a specific line of a graph definition
+type LoadError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// LoadFile reads a graph definition from a YAML file
+func (l *Loader[T]) LoadFile(path string) (*Graph[T], error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return l.Load(f, path)
+}
+
+// Load reads a graph definition from r. The name is used in error messages.
+// All validation problems are reported together, each as a *LoadError.
+func (l *Loader[T]) Load(r io.Reader, name string) (*Graph[T], error) {
+	var doc yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, &LoadError{File: name, Line: 1, Msg: "empty graph definition"}
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	p := &graphParser[T]{loader: l, file: name}
+	graph := p.parse(&doc)
+	if len(p.errs) > 0 {
+		return nil, errors.Join(p.errs...)
+	}
+	return graph, nil
+}
+
+// graphParser walks the YAML node tree so errors can carry line numbers
+type graphParser[T any] struct {
+	loader *Loader[T]
+	file   string
+	errs   []error
+}
+
+// pendingStage holds a stage whose dependencies are wired once all stages
+// are known, so stages may refer to ones defined later in the file
+type pendingStage[T any] struct {
+	stage *GraphStage[T]
+	after []*yaml.Node
+}
+
+func (p *graphParser[T]) errorf(node *yaml.Node, format string, args ...any) {
+	p.errs = append(p.errs, &LoadError{File: p.file, Line: node.Line, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (p *graphParser[T]) parse(doc *yaml.Node) *Graph[T] {
+	root := doc
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		p.errorf(root, "graph definition must be a mapping with a stages list")
+		return nil
+	}
+
+	var stagesNode *yaml.Node
+	for i := 0; i < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if key.Value == "stages" {
+			stagesNode = value
+		} else {
+			p.errorf(key, "unknown field %q", key.Value)
+		}
+	}
+	if stagesNode == nil {
+		p.errorf(root, "missing stages list")
+		return nil
+	}
+	if stagesNode.Kind != yaml.SequenceNode {
+		p.errorf(stagesNode, "stages must be a list")
+		return nil
+	}
+
+	graph := NewGraph[T]()
+	if p.loader.Registry != nil {
+		graph.UseRegistry(p.loader.Registry)
+	}
+	pending := make([]pendingStage[T], 0, len(stagesNode.Content))
+	for _, node := range stagesNode.Content {
+		if ps, ok := p.parseStage(graph, node); ok {
+			pending = append(pending, ps)
+		}
+	}
+
+	for _, ps := range pending {
+		for _, node := range ps.after {
+			dep := graph.stages[node.Value]
+			if dep == nil {
+				p.errorf(node, "stage %q: unknown dependency %q", ps.stage.name, node.Value)
+				continue
+			}
+			ps.stage.After(dep)
+		}
+	}
+
+	if len(p.errs) == 0 {
+		if err := graph.Validate(); err != nil {
+			p.validateError(err, pending)
+		}
+	}
+	return graph
+}
+
+// validateError reports an error from Graph.Validate, at the after entry
+// that closes the cycle if it is a *CycleError
+func (p *graphParser[T]) validateError(err error, pending []pendingStage[T]) {
+	var cycle *CycleError
+	if errors.As(err, &cycle) && len(cycle.Path) >= 2 {
+		from, to := cycle.Path[len(cycle.Path)-2], cycle.Path[len(cycle.Path)-1]
+		for _, ps := range pending {
+			if ps.stage.name != from {
+				continue
+			}
+			for _, node := range ps.after {
+				if node.Value == to {
+					p.errorf(node, "stage %q: %v", from, err)
+					return
+				}
+			}
+		}
+	}
+	p.errs = append(p.errs, fmt.Errorf("%s: %w", p.file, err))
+}
+
+func (p *graphParser[T]) parseStage(graph *Graph[T], node *yaml.Node) (pendingStage[T], bool) {
+	if node.Kind != yaml.MappingNode {
+		p.errorf(node, "stage must be a mapping")
+		return pendingStage[T]{}, false
+	}
+
+	fields := make(map[string]*yaml.Node)
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		switch key.Value {
+		case "name", "after", "platform", "requires", "unless", "when", "optional", "action":
+			if _, dup := fields[key.Value]; dup {
+				p.errorf(key, "duplicate field %q", key.Value)
+			}
+			fields[key.Value] = value
+		default:
+			p.errorf(key, "unknown stage field %q", key.Value)
+		}
+	}
+
+	nameNode := fields["name"]
+	if nameNode == nil {
+		p.errorf(node, "stage is missing a name")
+		return pendingStage[T]{}, false
+	}
+	name, ok := p.scalar(nameNode, "stage name")
+	if !ok {
+		return pendingStage[T]{}, false
+	}
+	if name == "" {
+		p.errorf(nameNode, "stage name must not be empty")
+		return pendingStage[T]{}, false
+	}
+	if graph.stages[name] != nil {
+		p.errorf(nameNode, "duplicate stage %q", name)
+		return pendingStage[T]{}, false
+	}
+
+	var run StageHandler[T]
+	if actionNode := fields["action"]; actionNode != nil {
+		run = p.parseAction(graph, name, actionNode)
+	} else {
+		p.errorf(node, "stage %q has no action", name)
+	}
+
+	stage := graph.AddStage(name, run)
+
+	if n := fields["platform"]; n != nil {
+		if platform, ok := p.scalar(n, "platform"); ok {
+			if !slices.Contains(knownPlatforms, platform) {
+				p.errorf(n, "stage %q: unknown platform %q", name, platform)
+			}
+			stage.platform = platform
+		}
+	}
+	if n := fields["requires"]; n != nil {
+		for _, cmd := range p.stringList(n, "requires") {
+			stage.Requires(cmd.Value)
+		}
+	}
+	if n := fields["unless"]; n != nil {
+		for _, cond := range p.conditionList(n) {
+			stage.Unless(cond)
+		}
+	}
+	if n := fields["when"]; n != nil {
+		for _, cond := range p.conditionList(n) {
+			stage.Unless(Not(cond))
+		}
+	}
+	if n := fields["optional"]; n != nil {
+		var optional bool
+		if err := n.Decode(&optional); err != nil {
+			p.errorf(n, "optional must be true or false")
+		} else if optional {
+			stage.Optional()
+		}
+	}
+
+	var after []*yaml.Node
+	if n := fields["after"]; n != nil {
+		after = p.stringList(n, "after")
+	}
+	return pendingStage[T]{stage: stage, after: after}, true
+}
+
+// parseAction builds the stage handler for an action mapping
+func (p *graphParser[T]) parseAction(graph *Graph[T], stageName string, node *yaml.Node) StageHandler[T] {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i < len(node.Content); i += 2 {
+			if node.Content[i].Value == "kind" {
+				return p.parseKindAction(graph, stageName, node)
+			}
+		}
+	}
+
+	var sudoNode *yaml.Node
+	if node.Kind == yaml.MappingNode && len(node.Content) == 4 {
+		for i := 0; i < len(node.Content); i += 2 {
+			if node.Content[i].Value == "sudo" {
+				sudoNode = node.Content[i+1]
+				node = &yaml.Node{Kind: yaml.MappingNode, Line: node.Line, Content: slices.Delete(slices.Clone(node.Content), i, i+2)}
+				break
+			}
+		}
+	}
+	if node.Kind != yaml.MappingNode || len(node.Content) != 2 {
+		p.errorf(node, "stage %q: action must have exactly one of handler, kind, shell, script or command", stageName)
+		return nil
+	}
+
+	var sudo bool
+	key, value := node.Content[0], node.Content[1]
+	if sudoNode != nil {
+		if err := sudoNode.Decode(&sudo); err != nil {
+			p.errorf(sudoNode, "stage %q: sudo must be true or false", stageName)
+		}
+		if key.Value != "shell" && key.Value != "script" && key.Value != "command" {
+			p.errorf(sudoNode, "stage %q: sudo only applies to shell, script and command actions", stageName)
+		}
+	}
+
+	switch key.Value {
+	case "handler":
+		name, ok := p.scalar(value, "handler")
+		if !ok {
+			return nil
+		}
+		handler, ok := p.loader.Handlers[name]
+		if !ok {
+			p.errorf(value, "stage %q: unknown handler %q", stageName, name)
+			return nil
+		}
+		return handler
+	case "shell":
+		script, ok := p.scalar(value, "shell")
+		if !ok {
+			return nil
+		}
+		return runCommand[T](exec.Cmd{Name: "sh", Args: []string{"-c", script}, Sudo: sudo})
+	case "script":
+		script, ok := p.scalar(value, "script")
+		if !ok {
+			return nil
+		}
+		return runScript[T](exec.Script{Text: script, Sudo: sudo})
+	case "command":
+		argv := p.stringList(value, "command")
+		if len(argv) == 0 {
+			p.errorf(value, "stage %q: command must not be empty", stageName)
+			return nil
+		}
+		args := make([]string, 0, len(argv)-1)
+		for _, arg := range argv[1:] {
+			args = append(args, arg.Value)
+		}
+		return runCommand[T](exec.Cmd{Name: argv[0].Value, Args: args, Sudo: sudo})
+	default:
+		p.errorf(key, "stage %q: unknown action %q", stageName, key.Value)
+		return nil
+	}
+}
+
+// parseKindAction builds the stage handler for a kind action with params
+func (p *graphParser[T]) parseKindAction(graph *Graph[T], stageName string, node *yaml.Node) StageHandler[T] {
+	var kindNode, paramsNode *yaml.Node
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		switch key.Value {
+		case "kind":
+			kindNode = value
+		case "params":
+			paramsNode = value
+		default:
+			p.errorf(key, "stage %q: unknown action field %q", stageName, key.Value)
+		}
+	}
+
+	kind, ok := p.scalar(kindNode, "kind")
+	if !ok {
+		return nil
+	}
+	if _, ok := graph.Registry().Lookup(kind); !ok {
+		p.errorf(kindNode, "stage %q: unknown action kind %q", stageName, kind)
+		return nil
+	}
+
+	params := Params{}
+	if paramsNode != nil {
+		if err := paramsNode.Decode(&params); err != nil {
+			p.errorf(paramsNode, "stage %q: params must be a mapping", stageName)
+			return nil
+		}
+	} else {
+		paramsNode = node
+	}
+
+	run, err := graph.Registry().Build(kind, params)
+	if err != nil {
+		p.errorf(paramsNode, "stage %q: %v", stageName, err)
+		return nil
+	}
+	return run
+}
+
+// conditionList parses a list of conditions, accepting a single condition too
+func (p *graphParser[T]) conditionList(node *yaml.Node) []Condition[T] {
+	items := []*yaml.Node{node}
+	if node.Kind == yaml.SequenceNode {
+		items = node.Content
+	}
+	conditions := make([]Condition[T], 0, len(items))
+	for _, item := range items {
+		if cond := p.parseCondition(item); cond != nil {
+			conditions = append(conditions, cond)
+		}
+	}
+	return conditions
+}
+
+// parseCondition maps a condition node onto the built-in conditions.
+// Conditions are either a bare name (is_mac) or a single-key mapping
+// (command_exists: git).
+func (p *graphParser[T]) parseCondition(node *yaml.Node) Condition[T] {
+	if node.Kind == yaml.ScalarNode {
+		switch node.Value {
+		case "is_mac":
+			return IsMac[T]()
+		case "is_linux":
+			return IsLinux[T]()
+		}
+		p.errorf(node, "unknown condition %q", node.Value)
+		return nil
+	}
+	if node.Kind != yaml.MappingNode || len(node.Content) != 2 {
+		p.errorf(node, "condition must be a name or a mapping with a single key")
+		return nil
+	}
+
+	key, value := node.Content[0], node.Content[1]
+	switch key.Value {
+	case "command_exists":
+		if cmd, ok := p.scalar(value, key.Value); ok {
+			return CommandExists[T](cmd)
+		}
+	case "file_exists":
+		if path, ok := p.scalar(value, key.Value); ok {
+			return FileExists[T](path)
+		}
+	case "env_set":
+		if env, ok := p.scalar(value, key.Value); ok {
+			return EnvSet[T](env)
+		}
+	case "is_mac", "is_linux":
+		var want bool
+		if err := value.Decode(&want); err != nil {
+			p.errorf(value, "%s must be true or false", key.Value)
+			return nil
+		}
+		cond := IsMac[T]()
+		if key.Value == "is_linux" {
+			cond = IsLinux[T]()
+		}
+		if !want {
+			return Not(cond)
+		}
+		return cond
+	case "not":
+		if cond := p.parseCondition(value); cond != nil {
+			return Not(cond)
+		}
+	case "and", "or":
+		if value.Kind != yaml.SequenceNode {
+			p.errorf(value, "%s must be a list of conditions", key.Value)
+			return nil
+		}
+		conditions := p.conditionList(value)
+		if len(conditions) != len(value.Content) {
+			return nil
+		}
+		if key.Value == "and" {
+			return And(conditions...)
+		}
+		return Or(conditions...)
+	default:
+		p.errorf(key, "unknown condition %q", key.Value)
+	}
+	return nil
+}
+
+// scalar returns the string value of a scalar node
+func (p *graphParser[T]) scalar(node *yaml.Node, field string) (string, bool) {
+	if node.Kind != yaml.ScalarNode {
+		p.errorf(node, "%s must be a string", field)
+		return "", false
+	}
+	return node.Value, true
+}
+
+// stringList returns the scalar nodes of a list, accepting a single scalar too
+func (p *graphParser[T]) stringList(node *yaml.Node, field string) []*yaml.Node {
+	if node.Kind == yaml.ScalarNode {
+		return []*yaml.Node{node}
+	}
+	if node.Kind != yaml.SequenceNode {
+		p.errorf(node, "%s must be a string or a list of strings", field)
+		return nil
+	}
+	items := make([]*yaml.Node, 0, len(node.Content))
+	for _, item := range node.Content {
+		if _, ok := p.scalar(item, field); ok {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,283 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cwood/dotgraph/exec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testGraphYAML = `
+stages:
+  - name: install-git
+    platform: linux
+    unless:
+      - command_exists: git
+    action:
+      shell: pacman -S --noconfirm git
+  - name: clone-dotfiles
+    after: [install-git]
+    requires: git
+    when:
+      - not:
+          env_set: DOTGRAPH_TEST_UNSET_12345
+    optional: true
+    action:
+      handler: clone
+  - name: link
+    after: clone-dotfiles
+    action:
+      command: [ln, -s, a, b]
+`
+
+func TestLoader_Load(t *testing.T) {
+	cloned := false
+	loader := &Loader[any]{
+		Handlers: map[string]StageHandler[any]{
+			"clone": func(req *Request[any]) error {
+				cloned = true
+				return nil
+			},
+		},
+	}
+
+	graph, err := loader.Load(strings.NewReader(testGraphYAML), "graph.yaml")
+	require.NoError(t, err)
+
+	install := graph.Stage("install-git")
+	require.NotNil(t, install)
+	assert.Equal(t, "linux", install.platform)
+	assert.Len(t, install.unless, 1)
+
+	clone := graph.Stage("clone-dotfiles")
+	require.NotNil(t, clone)
+	assert.Equal(t, []*GraphStage[any]{install}, clone.dependencies)
+	assert.Equal(t, []string{"git"}, clone.requires)
+	assert.True(t, clone.optional)
+
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+	graph.platform = "linux"
+
+	mockExec := req.Services.Executor.(*exec.MockExecutor)
+	mockExec.ExpectCommandNotFound("git").Once()
+	mockExec.ExpectRunContextSuccess(exec.Cmd{Name: "sh", Args: []string{"-c", "pacman -S --noconfirm git"}})
+	mockExec.ExpectCommandExists("git")
+	mockExec.ExpectRunContextSuccess(exec.Cmd{Name: "ln", Args: []string{"-s", "a", "b"}})
+
+	require.NoError(t, graph.Execute(context.Background(), req))
+	assert.True(t, cloned)
+	mockExec.AssertExpectations(t)
+}
+
+func TestLoader_Load_CommandFailure(t *testing.T) {
+	loader := &Loader[any]{}
+	graph, err := loader.Load(strings.NewReader(`
+stages:
+  - name: fail
+    action:
+      command: [false]
+`), "graph.yaml")
+	require.NoError(t, err)
+
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+
+	mockExec := req.Services.Executor.(*exec.MockExecutor)
+	mockExec.ExpectRunContext(exec.Cmd{Name: "false", Args: []string{}}, exec.RunResult{Error: errors.New("exit status 1"), LogFile: "/tmp/false.log"})
+
+	err = graph.Execute(context.Background(), req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "/tmp/false.log")
+}
+
+func TestLoader_Load_ValidationErrors(t *testing.T) {
+	loader := &Loader[any]{}
+
+	_, err := loader.Load(strings.NewReader(`stages:
+  - name: a
+    action:
+      handler: missing
+  - name: b
+    after: [nope]
+    unless:
+      - frobnicate: true
+    action:
+      shell: true
+  - name: a
+    action:
+      shell: true
+  - name: c
+    colour: blue
+  - name: d
+    platform: lnux
+    action:
+      shell: true
+`), "graph.yaml")
+	require.Error(t, err)
+
+	var loadErr *LoadError
+	require.True(t, errors.As(err, &loadErr))
+
+	msg := err.Error()
+	assert.Contains(t, msg, `graph.yaml:4: stage "a": unknown handler "missing"`)
+	assert.Contains(t, msg, `graph.yaml:8: unknown condition "frobnicate"`)
+	assert.Contains(t, msg, `graph.yaml:11: duplicate stage "a"`)
+	assert.Contains(t, msg, `graph.yaml:15: unknown stage field "colour"`)
+	assert.Contains(t, msg, `graph.yaml:14: stage "c" has no action`)
+	assert.Contains(t, msg, `graph.yaml:6: stage "b": unknown dependency "nope"`)
+	assert.Contains(t, msg, `graph.yaml:17: stage "d": unknown platform "lnux"`)
+}
+
+func TestLoader_Load_Cycle(t *testing.T) {
+	loader := &Loader[any]{}
+
+	_, err := loader.Load(strings.NewReader(`stages:
+  - name: a
+    after: [b]
+    action: {shell: "true"}
+  - name: b
+    after: [a]
+    action: {shell: "true"}
+`), "graph.yaml")
+	var loadErr *LoadError
+	require.ErrorAs(t, err, &loadErr)
+	assert.EqualError(t, err, `graph.yaml:6: stage "b": dependency cycle: a -> b -> a`)
+}
+
+func TestLoader_LoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "graph.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("stages:\n  - name: a\n    action: {shell: \"true\"}\n"), 0644))
+
+	graph, err := (&Loader[any]{}).LoadFile(path)
+	require.NoError(t, err)
+	assert.NotNil(t, graph.Stage("a"))
+}
+
+func TestLoader_Load_Sudo(t *testing.T) {
+	loader := &Loader[any]{Handlers: map[string]StageHandler[any]{"noop": func(*Request[any]) error { return nil }}}
+
+	graph, err := loader.Load(strings.NewReader(`stages:
+  - name: install
+    action:
+      command: [pacman, -S, git]
+      sudo: true
+`), "graph.yaml")
+	require.NoError(t, err)
+
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+
+	mockExec := req.Services.Executor.(*exec.MockExecutor)
+	mockExec.ExpectRunContextSuccess(exec.Cmd{Name: "pacman", Args: []string{"-S", "git"}, Sudo: true})
+
+	require.NoError(t, graph.Execute(context.Background(), req))
+	mockExec.AssertExpectations(t)
+
+	_, err = loader.Load(strings.NewReader(`stages:
+  - name: noop
+    action:
+      handler: noop
+      sudo: yes please
+`), "graph.yaml")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `graph.yaml:5: stage "noop": sudo must be true or false`)
+	assert.Contains(t, err.Error(), `graph.yaml:5: stage "noop": sudo only applies to shell, script and command actions`)
+}
+
+func TestLoader_Load_DryRunPreview(t *testing.T) {
+	graph, err := (&Loader[any]{}).Load(strings.NewReader(`stages:
+  - name: install
+    action:
+      command: [pacman, -S, git]
+      sudo: true
+  - name: dotfiles
+    after: [install]
+    action:
+      shell: stow -t ~ nvim
+  - name: configure
+    after: [dotfiles]
+    action:
+      script: echo configured
+`), "graph.yaml")
+	require.NoError(t, err)
+
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+	req.Options.DryRun = true
+	req.Options.Preview = exec.NewManifest()
+	req.Services.Executor = exec.Chain(req.Services.Executor, req.Options.Middlewares()...)
+
+	require.NoError(t, graph.Execute(context.Background(), req))
+
+	assert.Equal(t, []exec.ManifestEntry{
+		{Command: "pacman -S git", Name: "pacman", Elevated: true, Stages: []string{"install"}, Count: 1},
+		{Command: "sh -c stow -t ~ nvim", Name: "sh", Stages: []string{"dotfiles"}, Count: 1},
+		{Command: "bash -Eeuo pipefail -s", Name: "bash", Stages: []string{"configure"}, Count: 1},
+	}, req.Options.Preview.Entries())
+}
+
+func TestLoader_Load_DryRunPolicy(t *testing.T) {
+	graph, err := (&Loader[any]{}).Load(strings.NewReader(`stages:
+  - name: wipe
+    action:
+      command: [rm, -rf, /]
+`), "graph.yaml")
+	require.NoError(t, err)
+
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+	req.Options = Options{DryRun: true, Policy: &exec.DefaultPolicy}
+	req.Services.Executor = exec.Chain(req.Services.Executor, req.Options.Middlewares()...)
+
+	err = graph.Execute(context.Background(), req)
+
+	var violation *exec.PolicyViolationError
+	assert.ErrorAs(t, err, &violation)
+}
+
+func TestLoader_Load_Script(t *testing.T) {
+	graph, err := (&Loader[any]{}).Load(strings.NewReader(`stages:
+  - name: configure
+    action:
+      script: |
+        mkdir -p "$CONFIG_DIR"
+        ls "$CONFIG_DIR/missing" | wc -l
+        echo unreachable
+`), "graph.yaml")
+	require.NoError(t, err)
+
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+	req.Services.Executor = &exec.RealExecutor{LogDir: tmpDir}
+	req.Env.Vars = map[string]string{"CONFIG_DIR": filepath.Join(tmpDir, "config")}
+
+	err = graph.Execute(context.Background(), req)
+
+	var scriptErr *exec.ScriptError
+	require.ErrorAs(t, err, &scriptErr)
+	assert.Equal(t, 2, scriptErr.Line)
+	assert.DirExists(t, filepath.Join(tmpDir, "config"))
+}
+
+func TestLoader_Load_KindAfterParams(t *testing.T) {
+	graph, err := (&Loader[any]{}).Load(strings.NewReader(`stages:
+  - name: link-nvim
+    action:
+      params:
+        src: ~/dotfiles/nvim
+        dest: ~/.config/nvim
+      kind: symlink
+`), "graph.yaml")
+	require.NoError(t, err)
+
+	stage := graph.Stage("link-nvim")
+	require.NotNil(t, stage)
+	assert.NotNil(t, stage.run)
+}
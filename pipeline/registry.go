@@ -0,0 +1,299 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// ParamType is the type of a parameter accepted by an action kind
+type ParamType int
+
+const (
+	// StringParam is a single string value
+	StringParam ParamType = iota
+	// StringListParam is a list of strings; a single string is also accepted
+	StringListParam
+	// BoolParam is a boolean value
+	BoolParam
+	// IntParam is an integer value
+	IntParam
+)
+
+// String returns the name of the parameter type
+func (t ParamType) String() string {
+	switch t {
+	case StringParam:
+		return "string"
+	case StringListParam:
+		return "string list"
+	case BoolParam:
+		return "bool"
+	case IntParam:
+		return "int"
+	default:
+		return fmt.Sprintf("ParamType(%d)", int(t))
+	}
+}
+
+// Param describes one parameter accepted by an action kind
+type Param struct {
+	// Name is the key used in Params
+	Name string
+
+	// Type is the expected value type
+	Type ParamType
+
+	// Required parameters must be present
+	Required bool
+
+	// Default is used when an optional parameter is absent
+	Default any
+
+	// Doc is a one-line description shown in the kind listing
+	Doc string
+}
+
+// Params holds parameter values for an action. Values are normalized to
+// string, []string, bool or int according to the kind's schema before
+// they reach Build.
+type Params map[string]any
+
+// String returns a string parameter, or "" if unset
+func (p Params) String(name string) string {
+	s, _ := p[name].(string)
+	return s
+}
+
+// Strings returns a string list parameter, or nil if unset
+func (p Params) Strings(name string) []string {
+	s, _ := p[name].([]string)
+	return s
+}
+
+// Bool returns a bool parameter, or false if unset
+func (p Params) Bool(name string) bool {
+	b, _ := p[name].(bool)
+	return b
+}
+
+// Int returns an int parameter, or 0 if unset
+func (p Params) Int(name string) int {
+	i, _ := p[name].(int)
+	return i
+}
+
+// Kind is a reusable stage type. Go code registers kinds once and graphs
+// create stages from them by name with AddAction or from YAML definitions.
+type Kind[T any] struct {
+	// Name identifies the kind, e.g. "pkg.install"
+	Name string
+
+	// Doc is a one-line description shown in the kind listing
+	Doc string
+
+	// Params is the parameter schema
+	Params []Param
+
+	// Build creates the stage handler from validated parameters
+	Build func(params Params) (StageHandler[T], error)
+}
+
+// Registry holds the action kinds available to a graph
+type Registry[T any] struct {
+	mu    sync.RWMutex
+	kinds map[string]*Kind[T]
+}
+
+// NewRegistry creates a registry containing the built-in kinds
+// (pkg.install, git.clone and symlink)
+func NewRegistry[T any]() *Registry[T] {
+	r := &Registry[T]{kinds: make(map[string]*Kind[T])}
+	for _, kind := range builtinKinds[T]() {
+		r.MustRegister(kind)
+	}
+	return r
+}
+
+// Register adds a kind to the registry
+func (r *Registry[T]) Register(kind Kind[T]) error {
+	if kind.Name == "" {
+		return fmt.Errorf("action kind must have a name")
+	}
+	if kind.Build == nil {
+		return fmt.Errorf("action kind %s has no Build function", kind.Name)
+	}
+	seen := make(map[string]bool, len(kind.Params))
+	for _, param := range kind.Params {
+		if param.Name == "" {
+			return fmt.Errorf("action kind %s has a parameter without a name", kind.Name)
+		}
+		if seen[param.Name] {
+			return fmt.Errorf("action kind %s declares parameter %s twice", kind.Name, param.Name)
+		}
+		seen[param.Name] = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.kinds[kind.Name]; exists {
+		return fmt.Errorf("action kind %s is already registered", kind.Name)
+	}
+	r.kinds[kind.Name] = &kind
+	return nil
+}
+
+// MustRegister adds a kind to the registry and panics on error
+func (r *Registry[T]) MustRegister(kind Kind[T]) {
+	if err := r.Register(kind); err != nil {
+		panic(err)
+	}
+}
+
+// Lookup returns the kind with the given name
+func (r *Registry[T]) Lookup(name string) (*Kind[T], bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	kind, ok := r.kinds[name]
+	return kind, ok
+}
+
+// Kinds returns all registered kinds sorted by name
+func (r *Registry[T]) Kinds() []*Kind[T] {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	kinds := make([]*Kind[T], 0, len(r.kinds))
+	for _, kind := range r.kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i].Name < kinds[j].Name })
+	return kinds
+}
+
+// Build validates params against the kind's schema and creates its handler
+func (r *Registry[T]) Build(kindName string, params Params) (StageHandler[T], error) {
+	kind, ok := r.Lookup(kindName)
+	if !ok {
+		return nil, fmt.Errorf("unknown action kind %s", kindName)
+	}
+	normalized, err := kind.validate(params)
+	if err != nil {
+		return nil, err
+	}
+	handler, err := kind.Build(normalized)
+	if err != nil {
+		return nil, fmt.Errorf("action kind %s: %w", kind.Name, err)
+	}
+	return handler, nil
+}
+
+// WriteDocs writes a listing of every kind and its parameters
+func (r *Registry[T]) WriteDocs(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i, kind := range r.Kinds() {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "%s\n", kind.Name)
+		if kind.Doc != "" {
+			fmt.Fprintf(tw, "  %s\n", kind.Doc)
+		}
+		for _, param := range kind.Params {
+			presence := "optional"
+			if param.Required {
+				presence = "required"
+			} else if param.Default != nil {
+				presence = fmt.Sprintf("default %v", param.Default)
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", param.Name, param.Type, presence, param.Doc)
+		}
+	}
+	return tw.Flush()
+}
+
+// validate checks params against the schema and returns a normalized copy
+// with defaults applied
+func (k *Kind[T]) validate(params Params) (Params, error) {
+	known := make(map[string]bool, len(k.Params))
+	normalized := make(Params, len(k.Params))
+	var problems []string
+
+	for _, param := range k.Params {
+		known[param.Name] = true
+		value, ok := params[param.Name]
+		if !ok || value == nil {
+			if param.Required {
+				problems = append(problems, fmt.Sprintf("missing required parameter %s", param.Name))
+			} else if param.Default != nil {
+				normalized[param.Name] = param.Default
+			}
+			continue
+		}
+		converted, err := convertParam(param.Type, value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("parameter %s: %v", param.Name, err))
+			continue
+		}
+		normalized[param.Name] = converted
+	}
+
+	unknown := make([]string, 0)
+	for name := range params {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		problems = append(problems, fmt.Sprintf("unknown parameter %s", name))
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("action kind %s: %s", k.Name, strings.Join(problems, "; "))
+	}
+	return normalized, nil
+}
+
+// convertParam converts a Go or YAML-decoded value to the parameter type
+func convertParam(typ ParamType, value any) (any, error) {
+	switch typ {
+	case StringParam:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case StringListParam:
+		switch v := value.(type) {
+		case string:
+			return []string{v}, nil
+		case []string:
+			return append([]string(nil), v...), nil
+		case []any:
+			list := make([]string, 0, len(v))
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("expected %s, got list containing %T", typ, item)
+				}
+				list = append(list, s)
+			}
+			return list, nil
+		}
+	case BoolParam:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	case IntParam:
+		switch v := value.(type) {
+		case int:
+			return v, nil
+		case int64:
+			return int(v), nil
+		case uint64:
+			return int(v), nil
+		}
+	}
+	return nil, fmt.Errorf("expected %s, got %T", typ, value)
+}
@@ -0,0 +1,219 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cwood/dotgraph/exec"
+	"github.com/cwood/dotgraph/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_Register_Duplicate(t *testing.T) {
+	r := NewRegistry[any]()
+
+	err := r.Register(Kind[any]{
+		Name:  "symlink",
+		Build: func(Params) (StageHandler[any], error) { return nil, nil },
+	})
+
+	assert.Error(t, err)
+}
+
+func TestRegistry_Build_ValidatesParams(t *testing.T) {
+	r := NewRegistry[any]()
+
+	_, err := r.Build("git.clone", Params{"url": 42, "colour": "blue"})
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "parameter url: expected string, got int")
+	assert.Contains(t, err.Error(), "missing required parameter dest")
+	assert.Contains(t, err.Error(), "unknown parameter colour")
+}
+
+func TestRegistry_Build_UnknownKind(t *testing.T) {
+	r := NewRegistry[any]()
+
+	_, err := r.Build("nope", nil)
+
+	assert.EqualError(t, err, "unknown action kind nope")
+}
+
+func TestRegistry_Build_NormalizesParams(t *testing.T) {
+	r := NewRegistry[any]()
+
+	var got Params
+	r.MustRegister(Kind[any]{
+		Name: "test.kind",
+		Params: []Param{
+			{Name: "items", Type: StringListParam, Required: true},
+			{Name: "count", Type: IntParam, Default: 3},
+		},
+		Build: func(params Params) (StageHandler[any], error) {
+			got = params
+			return func(*Request[any]) error { return nil }, nil
+		},
+	})
+
+	_, err := r.Build("test.kind", Params{"items": []any{"a", "b"}})
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, got.Strings("items"))
+	assert.Equal(t, 3, got.Int("count"))
+}
+
+func TestGraph_AddAction_PkgInstall(t *testing.T) {
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+
+	graph := NewGraph[any]()
+	stage, err := graph.AddAction("tools", "pkg.install", Params{"packages": "git"})
+	require.NoError(t, err)
+	assert.Equal(t, "tools", stage.Name())
+
+	mockPkg := req.Services.Installer.(*pkg.MockManager)
+	mockPkg.ExpectInstallSuccess("git")
+
+	require.NoError(t, stage.run(req))
+	mockPkg.AssertExpectations(t)
+}
+
+func TestGraph_AddAction_PkgInstall_Middlewares(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "yay"), []byte("#!/bin/sh\nexit 0\n"), 0755))
+	t.Setenv("PATH", dir)
+
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+	policy := exec.Policy{Deny: []exec.CmdMatcher{exec.MatchArgs("-S", "--noconfirm", "htop")}}
+	req.Options = Options{Preview: exec.NewManifest(), Policy: &policy}
+	req.Services = NewServices("linux", req.Options.Middlewares()...)
+
+	graph := NewGraph[any]()
+	_, err := graph.AddAction("tools", "pkg.install", Params{"packages": "git"})
+	require.NoError(t, err)
+	_, err = graph.AddAction("monitoring", "pkg.install", Params{"packages": "htop"})
+	require.NoError(t, err)
+
+	report, err := graph.Run(context.Background(), req)
+
+	require.Error(t, err)
+	var violation *exec.PolicyViolationError
+	assert.ErrorAs(t, err, &violation)
+	assert.Equal(t, StatusSucceeded, report.Stage("tools").Status)
+	assert.ElementsMatch(t, []exec.ManifestEntry{
+		{Command: "yay -S --noconfirm git", Name: "yay", Stages: []string{"tools"}, Count: 1},
+		{Command: "yay -S --noconfirm htop", Name: "yay", Stages: []string{"monitoring"}, Count: 1},
+	}, req.Options.Preview.Entries())
+}
+
+func TestGraph_AddAction_PkgInstall_DryRunPreview(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "yay"), []byte("#!/bin/sh\nexit 1\n"), 0755))
+	t.Setenv("PATH", dir)
+
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+	req.Options = Options{DryRun: true, Preview: exec.NewManifest()}
+	req.Services = NewServices("linux", req.Options.Middlewares()...)
+	defer func() { assert.NoError(t, req.Services.Close()) }()
+
+	graph := NewGraph[any]()
+	_, err := graph.AddAction("tools", "pkg.install", Params{"packages": []string{"git", "tmux"}})
+	require.NoError(t, err)
+
+	require.NoError(t, graph.Execute(context.Background(), req))
+	assert.Equal(t, []exec.ManifestEntry{
+		{Command: "yay -S --noconfirm git tmux", Name: "yay", Stages: []string{"tools"}, Count: 1},
+	}, req.Options.Preview.Entries())
+}
+
+func TestGraph_AddAction_InvalidParams(t *testing.T) {
+	graph := NewGraph[any]()
+
+	_, err := graph.AddAction("tools", "pkg.install", Params{})
+
+	assert.Error(t, err)
+	assert.Nil(t, graph.Stage("tools"))
+}
+
+func TestGraph_AddAction_GitClone(t *testing.T) {
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+
+	graph := NewGraph[any]()
+	stage, err := graph.AddAction("dotfiles", "git.clone", Params{
+		"url":    "https://example.com/dotfiles.git",
+		"dest":   "~/dotfiles",
+		"branch": "main",
+	})
+	require.NoError(t, err)
+
+	mockExec := req.Services.Executor.(*exec.MockExecutor)
+	mockExec.ExpectRunContextFailure(exec.Cmd{
+		Name: "git",
+		Args: []string{"clone", "--branch", "main", "https://example.com/dotfiles.git", filepath.Join(tmpDir, "dotfiles")},
+	}, errors.New("exit status 128"))
+
+	err = stage.run(req)
+	assert.ErrorContains(t, err, "exit status 128")
+	mockExec.AssertExpectations(t)
+}
+
+func TestGraph_AddAction_Symlink(t *testing.T) {
+	req, tmpDir := newTestRequest[any](t, nil)
+	defer os.RemoveAll(tmpDir)
+
+	graph := NewGraph[any]()
+	stage, err := graph.AddAction("link", "symlink", Params{"src": "~/dotfiles/zshrc", "dest": "~/.zshrc"})
+	require.NoError(t, err)
+
+	require.NoError(t, stage.run(req))
+	target, err := os.Readlink(filepath.Join(tmpDir, ".zshrc"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(tmpDir, "dotfiles", "zshrc"), target)
+
+	// Running again is a no-op
+	require.NoError(t, stage.run(req))
+}
+
+func TestRegistry_WriteDocs(t *testing.T) {
+	var buf bytes.Buffer
+
+	require.NoError(t, NewRegistry[any]().WriteDocs(&buf))
+
+	docs := buf.String()
+	assert.True(t, strings.HasPrefix(docs, "git.clone\n"))
+	assert.Contains(t, docs, "pkg.install")
+	assert.Regexp(t, `packages\s+string list\s+required\s+Packages to install`, docs)
+	assert.Regexp(t, `force\s+bool\s+default false`, docs)
+}
+
+func TestLoader_Load_KindAction(t *testing.T) {
+	loader := &Loader[any]{}
+
+	graph, err := loader.Load(strings.NewReader(`stages:
+  - name: tools
+    action:
+      kind: pkg.install
+      params:
+        packages: [git, tmux]
+`), "graph.yaml")
+	require.NoError(t, err)
+	require.NotNil(t, graph.Stage("tools"))
+
+	_, err = loader.Load(strings.NewReader(`stages:
+  - name: tools
+    action:
+      kind: pkg.install
+      params:
+        packages: 3
+`), "graph.yaml")
+	assert.ErrorContains(t, err, "graph.yaml:6: stage \"tools\": action kind pkg.install: parameter packages")
+}
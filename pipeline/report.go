@@ -0,0 +1,118 @@
+package pipeline
+
+import (
+	"time"
+
+	"github.com/cwood/dotgraph/exec"
+)
+
+// StageStatus is the outcome of a stage in a graph run
+type StageStatus string
+
+const (
+	// StatusSucceeded means the stage ran without error
+	StatusSucceeded StageStatus = "succeeded"
+
+	// StatusFailed means the stage ran and returned an error, or a required
+	// command was missing
+	StatusFailed StageStatus = "failed"
+
+	// StatusSkipped means the stage did not run, see StageResult.Reason
+	StatusSkipped StageStatus = "skipped"
+)
+
+// StageResult records the outcome of one stage in a graph run
+type StageResult struct {
+	// Name is the stage name
+	Name string `json:"name"`
+
+	// Status is the outcome of the stage
+	Status StageStatus `json:"status"`
+
+	// Reason explains why a stage was skipped
+	Reason string `json:"reason,omitempty"`
+
+	// Err is the error returned by a failed stage. It is not persisted;
+	// reports loaded from history only carry Error.
+	Err error `json:"-"`
+
+	// Error is the message of Err
+	Error string `json:"error,omitempty"`
+
+	// Optional is true if the stage was marked optional
+	Optional bool `json:"optional,omitempty"`
+
+	// Start is when the stage started
+	Start time.Time `json:"start"`
+
+	// Duration is how long the stage took
+	Duration time.Duration `json:"duration"`
+
+	// Queued is how long the stage's commands waited for executor
+	// concurrency limits. It is included in Duration.
+	Queued time.Duration `json:"queued,omitempty"`
+
+	// Usage is the CPU time of the stage's commands and the peak memory of
+	// the largest one. It is nil if the stage ran no commands through a
+	// RealExecutor.
+	Usage *exec.Usage `json:"usage,omitempty"`
+}
+
+// End returns when the stage finished
+func (r *StageResult) End() time.Time {
+	return r.Start.Add(r.Duration)
+}
+
+// Fatal reports whether the stage failed the graph
+func (r *StageResult) Fatal() bool {
+	return r.Status == StatusFailed && !r.Optional
+}
+
+// skip marks the result as skipped
+func (r *StageResult) skip(reason string) *StageResult {
+	r.Status = StatusSkipped
+	r.Reason = reason
+	return r
+}
+
+// fail marks the result as failed
+func (r *StageResult) fail(err error) *StageResult {
+	r.Status = StatusFailed
+	r.Err = err
+	r.Error = err.Error()
+	return r
+}
+
+// Report summarizes a graph run
+type Report struct {
+	// Start is when the run started
+	Start time.Time `json:"start"`
+
+	// Duration is the wall-clock time of the whole run
+	Duration time.Duration `json:"duration"`
+
+	// Stages holds one result per stage in the order they finished
+	Stages []*StageResult `json:"stages"`
+}
+
+// Usage returns the CPU time of every stage's commands and the peak memory
+// of the largest one
+func (r *Report) Usage() exec.Usage {
+	var total exec.Usage
+	for _, result := range r.Stages {
+		if result.Usage != nil {
+			total.Add(*result.Usage)
+		}
+	}
+	return total
+}
+
+// Stage returns the result for the named stage, or nil if it is not in the report
+func (r *Report) Stage(name string) *StageResult {
+	for _, result := range r.Stages {
+		if result.Name == name {
+			return result
+		}
+	}
+	return nil
+}
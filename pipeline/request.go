@@ -1,15 +1,27 @@
 package pipeline
 
 import (
+	"context"
+	"io"
+	"log/slog"
+	"maps"
 	"os"
 	"runtime"
+	"slices"
 
 	"github.com/cwood/dotgraph/exec"
+	"github.com/cwood/dotgraph/logger"
 	"github.com/cwood/dotgraph/pkg"
 )
 
 // Request holds all dependencies and configuration for stage execution.
 // The type parameter T is the application-specific config type.
+//
+// During graph execution each stage receives its own shallow copy of the
+// request, so changes a stage makes to Env or Options do not leak into
+// stages running concurrently. Services and Config are shared: Config is
+// meant to be read-only unless the graph is given a clone function with
+// Graph.CloneConfig.
 type Request[T any] struct {
 	// Env contains runtime environment information
 	Env Environment
@@ -22,6 +34,60 @@ type Request[T any] struct {
 
 	// Config is the application-specific configuration
 	Config T
+
+	// Stage is the name of the stage this request was scoped to.
+	// It is empty outside of graph execution.
+	Stage string
+
+	// Log is a logger tagged with the stage name
+	Log *slog.Logger
+
+	ctx context.Context
+}
+
+// Context returns the request's context. During graph execution it is the
+// context passed to Graph.Run, so commands started with it stop when the
+// run is cancelled. It defaults to context.Background().
+func (r *Request[T]) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of the request with its context set to ctx
+func (r *Request[T]) WithContext(ctx context.Context) *Request[T] {
+	scoped := *r
+	scoped.ctx = ctx
+	return &scoped
+}
+
+// forStage returns a copy of the request scoped to a stage. Env.Vars is
+// copied and overlaid with the stage's variables, and the context names the
+// stage for failure logs and collects its command Stats.
+func (r *Request[T]) forStage(ctx context.Context, stage *GraphStage[T], cloneConfig func(T) T) *Request[T] {
+	scoped := *r
+	scoped.ctx, _ = exec.WithStats(exec.WithStage(ctx, stage.name))
+	scoped.Stage = stage.name
+
+	log := r.Log
+	if log == nil {
+		log = logger.Log
+	}
+	scoped.Log = log.With("stage", stage.name)
+
+	scoped.Env.Vars = maps.Clone(r.Env.Vars)
+	if len(stage.env) > 0 {
+		if scoped.Env.Vars == nil {
+			scoped.Env.Vars = make(map[string]string, len(stage.env))
+		}
+		maps.Copy(scoped.Env.Vars, stage.env)
+	}
+
+	if cloneConfig != nil {
+		scoped.Config = cloneConfig(r.Config)
+	}
+	return &scoped
 }
 
 // Environment contains runtime environment information
@@ -34,6 +100,10 @@ type Environment struct {
 
 	// WorkDir is the base directory for file operations (typically $HOME)
 	WorkDir string
+
+	// Vars holds environment variable overrides for commands run by a
+	// stage, set per stage with GraphStage.Env
+	Vars map[string]string
 }
 
 // Services contains injected service dependencies
@@ -45,13 +115,74 @@ type Services struct {
 	Installer pkg.Manager
 }
 
+// Close closes the executor if it can be, stopping what it keeps running
+// between commands such as the sudo keep-alive. Call it once the run is
+// over.
+func (s Services) Close() error {
+	if closer, ok := s.Executor.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
 // Options contains execution options
 type Options struct {
-	// DryRun when true prevents actual changes
+	// DryRun when true prevents actual changes. Commands are logged
+	// instead of run by the exec.DryRun middleware from Middlewares, which
+	// the executor must be built with; actions that change files directly
+	// check it themselves.
 	DryRun bool
 
 	// Verbose enables detailed logging
 	Verbose bool
+
+	// Policy, if set, restricts which commands the executor may run
+	Policy *exec.Policy
+
+	// Preview, if set, collects every command the run invokes, including
+	// the ones a dry run only logs
+	Preview *exec.Manifest
+
+	// Limits cap how many matching commands run at once across stages,
+	// e.g. exec.MaxConcurrent(2, "git")
+	Limits []exec.Limit
+}
+
+// Middlewares returns the executor middlewares the options call for, for
+// NewServices: an audit log of every command when Verbose, the preview
+// manifest, the policy, logging instead of running commands when DryRun,
+// and the concurrency limits. Dry runs do not queue for limits of commands
+// they never run.
+func (o Options) Middlewares() []exec.Middleware {
+	var middlewares []exec.Middleware
+	if o.Verbose {
+		middlewares = append(middlewares, exec.Audit(logger.Log))
+	}
+	if o.Preview != nil {
+		middlewares = append(middlewares, exec.Preview(o.Preview))
+	}
+	if o.Policy != nil {
+		middlewares = append(middlewares, exec.Enforce(*o.Policy))
+	}
+	if o.DryRun {
+		middlewares = append(middlewares, exec.DryRun(logger.Log))
+	}
+	if len(o.Limits) > 0 {
+		middlewares = append(middlewares, exec.Throttle(o.Limits...))
+	}
+	return middlewares
+}
+
+// Environ returns Vars in "KEY=value" form, sorted by key, for Cmd.Env
+func (e Environment) Environ() []string {
+	if len(e.Vars) == 0 {
+		return nil
+	}
+	env := make([]string, 0, len(e.Vars))
+	for _, key := range slices.Sorted(maps.Keys(e.Vars)) {
+		env = append(env, key+"="+e.Vars[key])
+	}
+	return env
 }
 
 // NewEnvironment creates an Environment with default values from the runtime
@@ -67,11 +198,14 @@ func NewEnvironment() Environment {
 	}
 }
 
-// NewServices creates Services with default real implementations
-func NewServices(osName string) Services {
+// NewServices creates Services with default real implementations. The
+// executor is wrapped in middlewares, outermost first, and the installer
+// runs through it.
+func NewServices(osName string, middlewares ...exec.Middleware) Services {
+	executor := exec.Chain(exec.NewRealExecutor(), middlewares...)
 	return Services{
-		Executor:  exec.NewRealExecutor(),
-		Installer: pkg.NewManager(osName),
+		Executor:  executor,
+		Installer: pkg.NewManager(osName, executor),
 	}
 }
 
@@ -0,0 +1,285 @@
+package pipeline
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/cwood/dotgraph/logger"
+)
+
+// SchedulePolicy decides which ready stage starts next when more stages are
+// ready than the parallelism limit allows
+type SchedulePolicy int
+
+const (
+	// ScheduleFIFO starts stages in the order they become ready
+	ScheduleFIFO SchedulePolicy = iota
+
+	// ScheduleCriticalPath starts the stage with the longest estimated chain
+	// of remaining work first, so long stages are not left until the end
+	ScheduleCriticalPath
+)
+
+// graphRun holds the state of a single execution of a graph
+type graphRun[T any] struct {
+	graph      *Graph[T]
+	remaining  map[*GraphStage[T]]int
+	dependents map[*GraphStage[T]][]*GraphStage[T]
+	blocked    map[*GraphStage[T]]string
+	finished   map[*GraphStage[T]]bool
+	priority   map[*GraphStage[T]]time.Duration
+	ready      []*GraphStage[T]
+	report     *Report
+	err        error
+}
+
+// stageCompletion is sent by a stage goroutine when it finishes
+type stageCompletion[T any] struct {
+	stage  *GraphStage[T]
+	result *StageResult
+}
+
+func newGraphRun[T any](g *Graph[T]) *graphRun[T] {
+	r := &graphRun[T]{
+		graph:      g,
+		remaining:  make(map[*GraphStage[T]]int, len(g.stages)),
+		dependents: g.dependents(),
+		blocked:    make(map[*GraphStage[T]]string),
+		finished:   make(map[*GraphStage[T]]bool, len(g.stages)),
+		report:     &Report{Stages: make([]*StageResult, 0, len(g.stages))},
+	}
+	if g.policy == ScheduleCriticalPath {
+		r.priority = g.ranks()
+	}
+
+	for _, name := range g.stageNames() {
+		stage := g.stages[name]
+		r.remaining[stage] = len(stage.dependencies)
+		if len(stage.dependencies) == 0 {
+			r.ready = append(r.ready, stage)
+		}
+	}
+	return r
+}
+
+// execute runs stages as their dependencies finish until none are left
+func (r *graphRun[T]) execute(ctx context.Context, req *Request[T]) (*Report, error) {
+	r.report.Start = time.Now()
+
+	limit := r.graph.parallelism
+	if limit <= 0 {
+		limit = len(r.graph.stages)
+	}
+
+	done := make(chan stageCompletion[T])
+	running := 0
+	for {
+		for running < limit && len(r.ready) > 0 && ctx.Err() == nil {
+			stage := r.next()
+			running++
+			go func() {
+				done <- stageCompletion[T]{stage: stage, result: r.graph.runStage(ctx, req, stage)}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+
+		c := <-done
+		running--
+		r.complete(c.stage, c.result)
+	}
+
+	if err := ctx.Err(); err != nil {
+		for _, name := range r.graph.stageNames() {
+			stage := r.graph.stages[name]
+			if !r.finished[stage] {
+				r.record(stage, &StageResult{Name: name, Status: StatusSkipped, Reason: "cancelled", Optional: stage.optional, Start: time.Now()})
+			}
+		}
+		if r.err == nil {
+			r.err = err
+		}
+	}
+
+	r.report.Duration = time.Since(r.report.Start)
+	return r.report, r.err
+}
+
+// next removes and returns the ready stage that should start next
+func (r *graphRun[T]) next() *GraphStage[T] {
+	best := 0
+	if r.priority != nil {
+		for i, stage := range r.ready {
+			if r.priority[stage] > r.priority[r.ready[best]] {
+				best = i
+			}
+		}
+	}
+	stage := r.ready[best]
+	r.ready = append(r.ready[:best], r.ready[best+1:]...)
+	return stage
+}
+
+// complete records a finished stage and releases its dependents. Dependents
+// of a failed stage are skipped, and so are their own dependents.
+func (r *graphRun[T]) complete(stage *GraphStage[T], result *StageResult) {
+	r.record(stage, result)
+	if result.Fatal() && r.err == nil {
+		r.err = result.Err
+	}
+
+	_, wasBlocked := r.blocked[stage]
+	blocks := result.Fatal() || wasBlocked
+	for _, dep := range r.dependents[stage] {
+		if blocks {
+			if _, ok := r.blocked[dep]; !ok {
+				r.blocked[dep] = stage.name
+			}
+		}
+		r.remaining[dep]--
+		if r.remaining[dep] > 0 {
+			continue
+		}
+
+		if blocker, ok := r.blocked[dep]; ok {
+			logger.Debug("Skipping stage", "stage", dep.name, "reason", "dependency failed", "dependency", blocker)
+			r.complete(dep, &StageResult{
+				Name:     dep.name,
+				Status:   StatusSkipped,
+				Reason:   "dependency " + blocker + " failed",
+				Optional: dep.optional,
+				Start:    time.Now(),
+			})
+			continue
+		}
+		r.ready = append(r.ready, dep)
+	}
+}
+
+// record adds a stage result to the report
+func (r *graphRun[T]) record(stage *GraphStage[T], result *StageResult) {
+	r.finished[stage] = true
+	r.report.Stages = append(r.report.Stages, result)
+}
+
+// dependents maps each stage to the stages that depend on it
+func (g *Graph[T]) dependents() map[*GraphStage[T]][]*GraphStage[T] {
+	dependents := make(map[*GraphStage[T]][]*GraphStage[T], len(g.stages))
+	for _, name := range g.stageNames() {
+		stage := g.stages[name]
+		for _, dep := range stage.dependencies {
+			dependents[dep] = append(dependents[dep], stage)
+		}
+	}
+	return dependents
+}
+
+// ranks returns, for each stage, its estimated duration plus the largest
+// rank of its dependents: the length of the longest chain it starts
+func (g *Graph[T]) ranks() map[*GraphStage[T]]time.Duration {
+	dependents := g.dependents()
+	ranks := make(map[*GraphStage[T]]time.Duration, len(g.stages))
+	var rank func(s *GraphStage[T]) time.Duration
+	rank = func(s *GraphStage[T]) time.Duration {
+		if r, ok := ranks[s]; ok {
+			return r
+		}
+		var longest time.Duration
+		for _, dep := range dependents[s] {
+			longest = max(longest, rank(dep))
+		}
+		ranks[s] = s.EstimatedDuration() + longest
+		return ranks[s]
+	}
+	for _, stage := range g.stages {
+		rank(stage)
+	}
+	return ranks
+}
+
+// LearnWeights sets each stage's estimated duration to its mean duration
+// across the successful runs in reports. Stages with an explicit Weight keep it.
+func (g *Graph[T]) LearnWeights(reports ...*Report) {
+	totals := make(map[string]time.Duration)
+	counts := make(map[string]int)
+	for _, report := range reports {
+		if report == nil {
+			continue
+		}
+		for _, result := range report.Stages {
+			if result.Status == StatusSucceeded {
+				totals[result.Name] += result.Duration
+				counts[result.Name]++
+			}
+		}
+	}
+	for name, stage := range g.stages {
+		if counts[name] > 0 {
+			stage.estimate = totals[name] / time.Duration(counts[name])
+		}
+	}
+}
+
+// CriticalPath returns the chain of stages that determined the total runtime
+// of a run, in execution order. It starts from the stage that finished last
+// and repeatedly follows the dependency that finished last.
+//
+// With a nil report it returns the chain with the largest total estimated
+// duration instead.
+func (g *Graph[T]) CriticalPath(report *Report) []string {
+	if report == nil {
+		return g.estimatedCriticalPath()
+	}
+
+	var last *StageResult
+	for _, result := range report.Stages {
+		if g.stages[result.Name] != nil && (last == nil || result.End().After(last.End())) {
+			last = result
+		}
+	}
+
+	path := make([]string, 0)
+	for last != nil {
+		path = append(path, last.Name)
+		var prev *StageResult
+		for _, dep := range g.stages[last.Name].dependencies {
+			if result := report.Stage(dep.name); result != nil && (prev == nil || result.End().After(prev.End())) {
+				prev = result
+			}
+		}
+		last = prev
+	}
+
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// estimatedCriticalPath follows the highest ranked stages from the root
+func (g *Graph[T]) estimatedCriticalPath() []string {
+	ranks := g.ranks()
+	dependents := g.dependents()
+
+	var current *GraphStage[T]
+	for _, name := range g.stageNames() {
+		stage := g.stages[name]
+		if len(stage.dependencies) == 0 && (current == nil || ranks[stage] > ranks[current]) {
+			current = stage
+		}
+	}
+
+	path := make([]string, 0)
+	for current != nil {
+		path = append(path, current.name)
+		children := dependents[current]
+		sort.SliceStable(children, func(i, j int) bool { return ranks[children[i]] > ranks[children[j]] })
+		current = nil
+		if len(children) > 0 {
+			current = children[0]
+		}
+	}
+	return path
+}
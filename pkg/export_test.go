@@ -0,0 +1,10 @@
+package pkg
+
+import "testing"
+
+// SetBrewPrefixes replaces the Homebrew prefixes until the test ends
+func SetBrewPrefixes(t *testing.T, prefixes []string) {
+	saved := brewPrefixes
+	brewPrefixes = prefixes
+	t.Cleanup(func() { brewPrefixes = saved })
+}
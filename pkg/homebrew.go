@@ -1,9 +1,10 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
 
 	dgexec "github.com/cwood/dotgraph/exec"
@@ -11,36 +12,81 @@ import (
 )
 
 // Homebrew implements the Manager interface for macOS Homebrew
-type Homebrew struct{}
+type Homebrew struct {
+	// Executor runs brew. If nil, exec.Default() is used.
+	Executor dgexec.CommandExecutor
+}
 
 // Install installs packages using Homebrew (batch install)
 func (h *Homebrew) Install(packages ...string) error {
+	return h.InstallContext(context.Background(), packages...)
+}
+
+// InstallContext installs packages like Install, running Homebrew with ctx
+func (h *Homebrew) InstallContext(ctx context.Context, packages ...string) error {
 	if len(packages) == 0 {
 		return nil
 	}
 
-	if !commandExists("brew") {
+	executor := executorOrDefault(h.Executor)
+	brew, inPath := findBrew(executor)
+	if brew == "" {
 		return fmt.Errorf("homebrew not installed")
 	}
 
 	logger.Info("Installing %d packages via Homebrew: %s", len(packages), strings.Join(packages, ", "))
 
 	args := append([]string{"install"}, packages...)
-	cmd := exec.Command("brew", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	err := installResult(executor.RunContext(ctx, dgexec.Cmd{
+		Name:   brew,
+		Args:   args,
+		OnLine: dgexec.LogLines(logger.Log.With("manager", "homebrew")),
+	}))
+	if err == nil && !inPath {
+		// Let later stages find brew and the packages it just installed
+		if env := dgexec.EnvironmentOf(executor); env != nil {
+			prefix := filepath.Dir(filepath.Dir(brew))
+			env.PrependPath(filepath.Join(prefix, "bin"), filepath.Join(prefix, "sbin"))
+		}
+	}
+	return err
+}
+
+// brewPrefixes are where Homebrew installs itself. A fresh install is not
+// in PATH until the shell profile runs `brew shellenv`.
+var brewPrefixes = []string{"/opt/homebrew", "/usr/local", "/home/linuxbrew/.linuxbrew"}
 
-	return cmd.Run()
+// findBrew returns "brew" if it is in the executor's PATH, or else the path
+// of brew in one of the Homebrew prefixes. It returns "" if brew is not
+// installed.
+func findBrew(executor dgexec.CommandExecutor) (brew string, inPath bool) {
+	if _, err := executor.LookPath("brew"); err == nil {
+		return "brew", true
+	}
+	for _, prefix := range brewPrefixes {
+		path := filepath.Join(prefix, "bin", "brew")
+		if info, err := os.Stat(path); err == nil && info.Mode()&0111 != 0 {
+			return path, false
+		}
+	}
+	return "", false
 }
 
 // IsInstalled checks if a package is installed via Homebrew
 func (h *Homebrew) IsInstalled(pkg string) bool {
-	if !commandExists("brew") {
+	executor := executorOrDefault(h.Executor)
+	if _, err := executor.LookPath("brew"); err != nil {
 		return false
 	}
 
-	cmd := exec.Command("brew", "list", pkg)
-	return cmd.Run() == nil
+	return executor.RunContext(context.Background(), dgexec.Cmd{Name: "brew", Args: []string{"list", pkg}}).Success
+}
+
+// Available reports whether brew is in PATH or in one of the Homebrew
+// prefixes
+func (h *Homebrew) Available() bool {
+	brew, _ := findBrew(executorOrDefault(h.Executor))
+	return brew != ""
 }
 
 // Name returns the name of the package manager
@@ -50,13 +96,14 @@ func (h *Homebrew) Name() string {
 
 // Bundle runs brew bundle with the specified Brewfile
 func (h *Homebrew) Bundle(brewfilePath string) error {
-	if !commandExists("brew") {
+	executor := executorOrDefault(h.Executor)
+	if _, err := executor.LookPath("brew"); err != nil {
 		return fmt.Errorf("homebrew not installed")
 	}
 
 	expandedPath := os.ExpandEnv(brewfilePath)
-	
-	result := dgexec.RunQuiet("brew", "bundle", "--file="+expandedPath)
+
+	result := executor.Run("brew", "bundle", "--file="+expandedPath)
 	if result.Success {
 		logger.Info("  ✓ Brewfile packages installed")
 		return nil
@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dgexec "github.com/cwood/dotgraph/exec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHomebrew_Bundle(t *testing.T) {
+	mockExec := new(dgexec.MockExecutor)
+	mockExec.ExpectCommandExists("brew")
+	mockExec.ExpectRunSuccess("brew", []string{"bundle", "--file=/dotfiles/Brewfile"})
+	brew := &Homebrew{Executor: mockExec}
+
+	err := brew.Bundle("/dotfiles/Brewfile")
+
+	assert.NoError(t, err)
+	mockExec.AssertExpectations(t)
+}
+
+func TestHomebrew_Bundle_Failure(t *testing.T) {
+	mockExec := new(dgexec.MockExecutor)
+	mockExec.ExpectCommandExists("brew")
+	mockExec.ExpectRunFailure("brew", []string{"bundle", "--file=/dotfiles/Brewfile"}, errors.New("exit status 1"))
+	dgexec.SetDefault(mockExec)
+	defer dgexec.SetDefault(nil)
+
+	err := (&Homebrew{}).Bundle("/dotfiles/Brewfile")
+
+	assert.EqualError(t, err, "exit status 1")
+	mockExec.AssertExpectations(t)
+}
+
+func TestHomebrew_Bundle_NotInstalled(t *testing.T) {
+	mockExec := new(dgexec.MockExecutor)
+	mockExec.ExpectCommandNotFound("brew")
+
+	err := (&Homebrew{Executor: mockExec}).Bundle("Brewfile")
+
+	assert.EqualError(t, err, "homebrew not installed")
+}
+
+func TestHomebrew_Install_FreshPrefix(t *testing.T) {
+	prefix := t.TempDir()
+	brew := filepath.Join(prefix, "bin", "brew")
+	require.NoError(t, os.MkdirAll(filepath.Dir(brew), 0755))
+	require.NoError(t, os.WriteFile(brew, []byte("#!/bin/sh\ntouch \"$(dirname \"$0\")/$2\"\nchmod +x \"$(dirname \"$0\")/$2\"\n"), 0755))
+	defer func(prefixes []string) { brewPrefixes = prefixes }(brewPrefixes)
+	brewPrefixes = []string{filepath.Join(t.TempDir(), "missing"), prefix}
+
+	executor := &dgexec.RealExecutor{LogDir: t.TempDir(), Env: dgexec.NewEnvironment([]string{"PATH=/usr/bin:/bin"})}
+	_, err := executor.LookPath("brew")
+	require.Error(t, err)
+
+	require.NoError(t, (&Homebrew{Executor: executor}).Install("ripgrep"))
+
+	path, err := executor.LookPath("ripgrep")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(prefix, "bin", "ripgrep"), path)
+	assert.Equal(t, []string{filepath.Join(prefix, "bin"), filepath.Join(prefix, "sbin"), "/usr/bin", "/bin"}, executor.Env.Path())
+}
+
+func TestHomebrew_Install_NotInstalled(t *testing.T) {
+	defer func(prefixes []string) { brewPrefixes = prefixes }(brewPrefixes)
+	brewPrefixes = nil
+	mockExec := new(dgexec.MockExecutor)
+	mockExec.ExpectCommandNotFound("brew")
+
+	err := (&Homebrew{Executor: mockExec}).Install("git")
+
+	assert.EqualError(t, err, "homebrew not installed")
+	mockExec.AssertExpectations(t)
+}
+
+func TestHomebrew_IsInstalled(t *testing.T) {
+	mockExec := new(dgexec.MockExecutor)
+	mockExec.ExpectCommandExists("brew")
+	mockExec.ExpectRunContextSuccess(dgexec.Cmd{Name: "brew", Args: []string{"list", "git"}})
+
+	assert.True(t, (&Homebrew{Executor: mockExec}).IsInstalled("git"))
+	mockExec.AssertExpectations(t)
+}
+
+func TestHomebrew_IsInstalled_NotInstalled(t *testing.T) {
+	mockExec := new(dgexec.MockExecutor)
+	mockExec.ExpectCommandNotFound("brew")
+
+	assert.False(t, (&Homebrew{Executor: mockExec}).IsInstalled("git"))
+	mockExec.AssertExpectations(t)
+}
@@ -1,8 +1,10 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
+
+	dgexec "github.com/cwood/dotgraph/exec"
 )
 
 // Manager defines the interface for package managers
@@ -13,21 +15,45 @@ type Manager interface {
 	Name() string
 }
 
+// ContextInstaller is implemented by managers whose installs can run with
+// a context, so they are cancelled with the run and attributed to the
+// stage that asked for them
+type ContextInstaller interface {
+	InstallContext(ctx context.Context, packages ...string) error
+}
+
+// InstallContext installs packages with m, passing ctx on if m is a
+// ContextInstaller
+func InstallContext(ctx context.Context, m Manager, packages ...string) error {
+	if installer, ok := m.(ContextInstaller); ok {
+		return installer.InstallContext(ctx, packages...)
+	}
+	return m.Install(packages...)
+}
+
 // Package manager priority by OS
-var managerPriority = map[string][]Manager{
-	"darwin": {&Homebrew{}},
-	"linux":  {&Yay{}, &Pacman{}},
+var managerPriority = map[string][]func(dgexec.CommandExecutor) Manager{
+	"darwin": {
+		func(e dgexec.CommandExecutor) Manager { return &Homebrew{Executor: e} },
+	},
+	"linux": {
+		func(e dgexec.CommandExecutor) Manager { return &Yay{Executor: e} },
+		func(e dgexec.CommandExecutor) Manager { return &Pacman{Executor: e} },
+	},
 }
 
-// NewManager returns the first available package manager for the OS
-func NewManager(os string) Manager {
+// NewManager returns the first available package manager for the OS. It
+// runs its commands and looks them up with executor, so installs see the
+// same environment and middlewares as other commands. If executor is nil,
+// exec.Default() is used.
+func NewManager(os string, executor dgexec.CommandExecutor) Manager {
 	managers, ok := managerPriority[os]
 	if !ok {
 		return &Noop{}
 	}
 
-	for _, m := range managers {
-		if m.Available() {
+	for _, newManager := range managers {
+		if m := newManager(executor); m.Available() {
 			return m
 		}
 	}
@@ -54,8 +80,21 @@ func (n *Noop) Name() string {
 	return "noop"
 }
 
-// commandExists checks if a command is available in PATH
-func commandExists(cmd string) bool {
-	_, err := exec.LookPath(cmd)
-	return err == nil
+// executorOrDefault returns e, or the default executor if e is nil
+func executorOrDefault(e dgexec.CommandExecutor) dgexec.CommandExecutor {
+	if e == nil {
+		return dgexec.Default()
+	}
+	return e
+}
+
+// installResult converts the result of an install command into an error
+func installResult(result dgexec.RunResult) error {
+	if result.Success {
+		return nil
+	}
+	if result.LogFile != "" {
+		return fmt.Errorf("%s failed: %w (log: %s)", result.Command, result.Error, result.LogFile)
+	}
+	return fmt.Errorf("%s failed: %w", result.Command, result.Error)
 }
@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	dgexec "github.com/cwood/dotgraph/exec"
+	"github.com/cwood/dotgraph/logger"
+)
+
+// Pacman implements the Manager interface for Arch Linux pacman. It is
+// used when yay is not installed, so only repository packages are found.
+type Pacman struct {
+	// Executor runs pacman. If nil, exec.Default() is used.
+	Executor dgexec.CommandExecutor
+}
+
+// Install installs packages using pacman (batch install). Packages that
+// are already up to date are skipped.
+func (p *Pacman) Install(packages ...string) error {
+	return p.InstallContext(context.Background(), packages...)
+}
+
+// InstallContext installs packages like Install, running pacman with ctx
+func (p *Pacman) InstallContext(ctx context.Context, packages ...string) error {
+	if len(packages) == 0 {
+		return nil
+	}
+
+	executor := executorOrDefault(p.Executor)
+	if _, err := executor.LookPath("pacman"); err != nil {
+		return fmt.Errorf("pacman not installed")
+	}
+
+	logger.Info("Installing %d packages via pacman: %s", len(packages), strings.Join(packages, ", "))
+
+	args := append([]string{"-S", "--noconfirm", "--needed"}, packages...)
+	return installResult(executor.RunContext(ctx, dgexec.Cmd{
+		Name:   "pacman",
+		Args:   args,
+		Sudo:   true,
+		OnLine: dgexec.LogLines(logger.Log.With("manager", "pacman")),
+	}))
+}
+
+// IsInstalled checks if a package is installed via pacman
+func (p *Pacman) IsInstalled(pkg string) bool {
+	executor := executorOrDefault(p.Executor)
+	if _, err := executor.LookPath("pacman"); err != nil {
+		return false
+	}
+
+	return executor.RunContext(context.Background(), dgexec.Cmd{Name: "pacman", Args: []string{"-Qi", pkg}}).Success
+}
+
+// Available reports whether pacman is in PATH
+func (p *Pacman) Available() bool {
+	_, err := executorOrDefault(p.Executor).LookPath("pacman")
+	return err == nil
+}
+
+// Name returns the name of the package manager
+func (p *Pacman) Name() string {
+	return "pacman"
+}
@@ -0,0 +1,31 @@
+package pkg
+
+import (
+	"testing"
+
+	dgexec "github.com/cwood/dotgraph/exec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacman_Install(t *testing.T) {
+	mockExec := new(dgexec.MockExecutor)
+	mockExec.ExpectCommandExists("pacman")
+	mockExec.ExpectCmd(dgexec.RunResult{Success: true},
+		dgexec.MatchName("pacman"),
+		dgexec.MatchArgs("-S", "--noconfirm", "--needed", "git", "tmux"),
+		dgexec.MatchSudo(true),
+	)
+
+	err := (&Pacman{Executor: mockExec}).Install("git", "tmux")
+
+	assert.NoError(t, err)
+	mockExec.AssertExpectations(t)
+}
+
+func TestPacman_Available(t *testing.T) {
+	mockExec := new(dgexec.MockExecutor)
+	mockExec.ExpectCommandNotFound("pacman")
+
+	assert.False(t, (&Pacman{Executor: mockExec}).Available())
+	mockExec.AssertExpectations(t)
+}
@@ -0,0 +1,32 @@
+package pkg_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cwood/dotgraph/pipeline"
+	"github.com/cwood/dotgraph/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewServices_HomebrewFreshPrefix(t *testing.T) {
+	prefix := t.TempDir()
+	brew := filepath.Join(prefix, "bin", "brew")
+	require.NoError(t, os.MkdirAll(filepath.Dir(brew), 0755))
+	require.NoError(t, os.WriteFile(brew, []byte("#!/bin/sh\ntouch \"$(dirname \"$0\")/$2\"\nchmod +x \"$(dirname \"$0\")/$2\"\n"), 0755))
+	pkg.SetBrewPrefixes(t, []string{prefix})
+	t.Setenv("PATH", "/usr/bin:/bin")
+
+	services := pipeline.NewServices("darwin")
+	require.IsType(t, &pkg.Homebrew{}, services.Installer)
+	_, err := services.Executor.LookPath("ripgrep")
+	require.Error(t, err)
+
+	require.NoError(t, services.Installer.Install("ripgrep"))
+
+	path, err := services.Executor.LookPath("ripgrep")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(prefix, "bin", "ripgrep"), path)
+}
@@ -1,46 +1,61 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
-	"os"
-	"os/exec"
 	"strings"
 
+	dgexec "github.com/cwood/dotgraph/exec"
 	"github.com/cwood/dotgraph/logger"
 )
 
 // Yay implements the Manager interface for Arch Linux yay
-type Yay struct{}
+type Yay struct {
+	// Executor runs yay. If nil, exec.Default() is used.
+	Executor dgexec.CommandExecutor
+}
 
 // Install installs packages using yay (batch install)
 // yay handles both pacman repos and AUR packages
 func (y *Yay) Install(packages ...string) error {
+	return y.InstallContext(context.Background(), packages...)
+}
+
+// InstallContext installs packages like Install, running yay with ctx
+func (y *Yay) InstallContext(ctx context.Context, packages ...string) error {
 	if len(packages) == 0 {
 		return nil
 	}
 
-	if !commandExists("yay") {
+	executor := executorOrDefault(y.Executor)
+	if _, err := executor.LookPath("yay"); err != nil {
 		return fmt.Errorf("yay not installed")
 	}
 
 	logger.Info("Installing %d packages via yay: %s", len(packages), strings.Join(packages, ", "))
 
 	args := append([]string{"-S", "--noconfirm"}, packages...)
-	cmd := exec.Command("yay", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	return cmd.Run()
+	return installResult(executor.RunContext(ctx, dgexec.Cmd{
+		Name:   "yay",
+		Args:   args,
+		OnLine: dgexec.LogLines(logger.Log.With("manager", "yay")),
+	}))
 }
 
 // IsInstalled checks if a package is installed via yay/pacman
 func (y *Yay) IsInstalled(pkg string) bool {
-	if !commandExists("yay") {
+	executor := executorOrDefault(y.Executor)
+	if _, err := executor.LookPath("yay"); err != nil {
 		return false
 	}
 
-	cmd := exec.Command("yay", "-Qi", pkg)
-	return cmd.Run() == nil
+	return executor.RunContext(context.Background(), dgexec.Cmd{Name: "yay", Args: []string{"-Qi", pkg}}).Success
+}
+
+// Available reports whether yay is in PATH
+func (y *Yay) Available() bool {
+	_, err := executorOrDefault(y.Executor).LookPath("yay")
+	return err == nil
 }
 
 // Name returns the name of the package manager
@@ -0,0 +1,78 @@
+package redact
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Handler is a slog.Handler that masks secrets in messages and attribute
+// values before passing records on
+type Handler struct {
+	next     slog.Handler
+	redactor *Redactor
+}
+
+// NewHandler wraps next so records are redacted with r. If r is nil, the
+// Default redactor is used.
+func NewHandler(next slog.Handler, r *Redactor) *Handler {
+	if r == nil {
+		r = Default
+	}
+	return &Handler{next: next, redactor: r}
+}
+
+// Enabled reports whether the wrapped handler handles records at level
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle redacts the record and passes it to the wrapped handler
+func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, h.redactor.String(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.attr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+// WithAttrs returns a handler whose attributes are redacted once up front
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = h.attr(attr)
+	}
+	return &Handler{next: h.next.WithAttrs(redacted), redactor: h.redactor}
+}
+
+// WithGroup returns a handler that nests attributes in a group
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{next: h.next.WithGroup(name), redactor: h.redactor}
+}
+
+// attr redacts string-like attribute values, including inside groups
+func (h *Handler) attr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, h.redactor.String(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		redacted := make([]any, len(group))
+		for i, a := range group {
+			redacted[i] = h.attr(a)
+		}
+		return slog.Group(attr.Key, redacted...)
+	case slog.KindAny:
+		switch v := value.Any().(type) {
+		case error:
+			return slog.String(attr.Key, h.redactor.String(v.Error()))
+		case fmt.Stringer:
+			return slog.String(attr.Key, h.redactor.String(v.String()))
+		case []string:
+			return slog.Any(attr.Key, h.redactor.Strings(v))
+		}
+	}
+	return slog.Attr{Key: attr.Key, Value: value}
+}